@@ -5,10 +5,24 @@ import (
 )
 
 func Register() {
-	rego.RegisterBuiltinDyn(checkPermissionBuiltinDecl, checkPermissionBuiltinImpl)
-	rego.RegisterBuiltinDyn(lookupResourcesBuiltinDecl, lookupResourcesBuiltinImpl)
-	rego.RegisterBuiltinDyn(lookupSubjectsBuiltinDecl, lookupSubjectsBuiltinImpl)
-	rego.RegisterBuiltin3(WriteRelationshipsBuiltinDecl, WriteRelationshipsBuiltinImpl)
-	rego.RegisterBuiltinDyn(ReadRelationshipsBuiltinDecl, ReadRelationshipsBuiltinImpl)
-	rego.RegisterBuiltinDyn(DeleteRelationshipsBuiltinDecl, DeleteRelationshipsBuiltinImpl)
+	rego.RegisterBuiltinDyn(withArgs(checkPermissionBuiltinDecl, withUnavailablePolicy(checkPermissionBuiltinDecl, checkPermissionBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(checkPermissionBuiltinDecl), withUnavailablePolicy(checkPermissionBuiltinDecl, checkPermissionBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(checkBulkPermissionsBuiltinDecl, withUnavailablePolicy(checkBulkPermissionsBuiltinDecl, checkBulkPermissionsBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(checkBulkPermissionsBuiltinDecl), withUnavailablePolicy(checkBulkPermissionsBuiltinDecl, checkBulkPermissionsBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(lookupResourcesBuiltinDecl, withUnavailablePolicy(lookupResourcesBuiltinDecl, lookupResourcesBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(lookupResourcesBuiltinDecl), withUnavailablePolicy(lookupResourcesBuiltinDecl, lookupResourcesBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(lookupSubjectsBuiltinDecl, withUnavailablePolicy(lookupSubjectsBuiltinDecl, lookupSubjectsBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(lookupSubjectsBuiltinDecl), withUnavailablePolicy(lookupSubjectsBuiltinDecl, lookupSubjectsBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(WriteRelationshipsBuiltinDecl, WriteRelationshipsBuiltinImpl))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(WriteRelationshipsBuiltinDecl), WriteRelationshipsBuiltinImpl))
+	rego.RegisterBuiltinDyn(withArgs(ReadRelationshipsBuiltinDecl, withUnavailablePolicy(ReadRelationshipsBuiltinDecl, ReadRelationshipsBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(ReadRelationshipsBuiltinDecl), withUnavailablePolicy(ReadRelationshipsBuiltinDecl, ReadRelationshipsBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(DeleteRelationshipsBuiltinDecl, DeleteRelationshipsBuiltinImpl))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(DeleteRelationshipsBuiltinDecl), DeleteRelationshipsBuiltinImpl))
+	rego.RegisterBuiltinDyn(withArgs(expandPermissionTreeBuiltinDecl, withUnavailablePolicy(expandPermissionTreeBuiltinDecl, expandPermissionTreeBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(expandPermissionTreeBuiltinDecl), withUnavailablePolicy(expandPermissionTreeBuiltinDecl, expandPermissionTreeBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(readSchemaBuiltinDecl, withUnavailablePolicy(readSchemaBuiltinDecl, readSchemaBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(readSchemaBuiltinDecl), withUnavailablePolicy(readSchemaBuiltinDecl, readSchemaBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(reflectSchemaBuiltinDecl, withUnavailablePolicy(reflectSchemaBuiltinDecl, reflectSchemaBuiltinImpl)))
+	rego.RegisterBuiltinDyn(withArgs(withOptions(reflectSchemaBuiltinDecl), withUnavailablePolicy(reflectSchemaBuiltinDecl, reflectSchemaBuiltinImpl)))
 }
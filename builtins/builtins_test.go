@@ -0,0 +1,313 @@
+package builtins
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSpicedb answers every request the builtins send with a minimal successful response. The replica
+// denies checks and rejects zedtokens newer than its own, like a read replica lagging behind.
+type fakeSpicedb struct {
+	authzedpb.UnimplementedPermissionsServiceServer
+	authzedpb.UnimplementedSchemaServiceServer
+	replica bool
+}
+
+var zedToken = &authzedpb.ZedToken{Token: "token"}
+
+// checkPermissionCalls counts the CheckPermission requests received by the fake SpiceDB.
+var checkPermissionCalls atomic.Int64
+
+func (f fakeSpicedb) CheckPermission(_ context.Context, req *authzedpb.CheckPermissionRequest) (*authzedpb.CheckPermissionResponse, error) {
+	checkPermissionCalls.Add(1)
+
+	permissionship := authzedpb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	if f.replica {
+		if token := req.Consistency.GetAtLeastAsFresh().GetToken(); token != "" && token != zedToken.Token {
+			return nil, status.Error(codes.OutOfRange, "invalid zedtoken")
+		}
+		permissionship = authzedpb.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION
+	}
+
+	return &authzedpb.CheckPermissionResponse{CheckedAt: zedToken, Permissionship: permissionship}, nil
+}
+
+func (fakeSpicedb) CheckBulkPermissions(_ context.Context, req *authzedpb.CheckBulkPermissionsRequest) (*authzedpb.CheckBulkPermissionsResponse, error) {
+	resp := &authzedpb.CheckBulkPermissionsResponse{CheckedAt: zedToken}
+	for _, item := range req.Items {
+		resp.Pairs = append(resp.Pairs, &authzedpb.CheckBulkPermissionsPair{
+			Request: item,
+			Response: &authzedpb.CheckBulkPermissionsPair_Item{Item: &authzedpb.CheckBulkPermissionsResponseItem{
+				Permissionship: authzedpb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION,
+			}},
+		})
+	}
+	return resp, nil
+}
+
+func (fakeSpicedb) LookupResources(req *authzedpb.LookupResourcesRequest, stream grpc.ServerStreamingServer[authzedpb.LookupResourcesResponse]) error {
+	return stream.Send(&authzedpb.LookupResourcesResponse{
+		LookedUpAt:       zedToken,
+		ResourceObjectId: "doc1",
+		Permissionship:   authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION,
+	})
+}
+
+func (fakeSpicedb) LookupSubjects(req *authzedpb.LookupSubjectsRequest, stream grpc.ServerStreamingServer[authzedpb.LookupSubjectsResponse]) error {
+	if err := stream.Send(&authzedpb.LookupSubjectsResponse{
+		LookedUpAt: zedToken,
+		Subject: &authzedpb.ResolvedSubject{
+			SubjectObjectId: "alice",
+			Permissionship:  authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION,
+		},
+	}); err != nil || req.Resource.ObjectId != "caveated" {
+		return err
+	}
+
+	// `user:* with in_office - user:bob` and carol with in_office
+	return errors.Join(
+		stream.Send(&authzedpb.LookupSubjectsResponse{
+			LookedUpAt: zedToken,
+			Subject: &authzedpb.ResolvedSubject{
+				SubjectObjectId:   "*",
+				Permissionship:    authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION,
+				PartialCaveatInfo: &authzedpb.PartialCaveatInfo{MissingRequiredContext: []string{"ip"}},
+			},
+			ExcludedSubjects: []*authzedpb.ResolvedSubject{{SubjectObjectId: "bob"}},
+		}),
+		stream.Send(&authzedpb.LookupSubjectsResponse{
+			LookedUpAt: zedToken,
+			Subject: &authzedpb.ResolvedSubject{
+				SubjectObjectId:   "carol",
+				Permissionship:    authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION,
+				PartialCaveatInfo: &authzedpb.PartialCaveatInfo{MissingRequiredContext: []string{"ip"}},
+			},
+		}),
+	)
+}
+
+func (fakeSpicedb) ReadRelationships(req *authzedpb.ReadRelationshipsRequest, stream grpc.ServerStreamingServer[authzedpb.ReadRelationshipsResponse]) error {
+	return stream.Send(&authzedpb.ReadRelationshipsResponse{
+		ReadAt: zedToken,
+		Relationship: &authzedpb.Relationship{
+			Resource: &authzedpb.ObjectReference{ObjectType: "document", ObjectId: "doc1"},
+			Relation: "viewer",
+			Subject:  &authzedpb.SubjectReference{Object: &authzedpb.ObjectReference{ObjectType: "user", ObjectId: "alice"}},
+		},
+	})
+}
+
+func (fakeSpicedb) WriteRelationships(context.Context, *authzedpb.WriteRelationshipsRequest) (*authzedpb.WriteRelationshipsResponse, error) {
+	return &authzedpb.WriteRelationshipsResponse{WrittenAt: zedToken}, nil
+}
+
+func (fakeSpicedb) DeleteRelationships(context.Context, *authzedpb.DeleteRelationshipsRequest) (*authzedpb.DeleteRelationshipsResponse, error) {
+	return &authzedpb.DeleteRelationshipsResponse{DeletedAt: zedToken}, nil
+}
+
+func (fakeSpicedb) ExpandPermissionTree(context.Context, *authzedpb.ExpandPermissionTreeRequest) (*authzedpb.ExpandPermissionTreeResponse, error) {
+	return &authzedpb.ExpandPermissionTreeResponse{
+		ExpandedAt: zedToken,
+		TreeRoot: &authzedpb.PermissionRelationshipTree{
+			TreeType: &authzedpb.PermissionRelationshipTree_Leaf{Leaf: &authzedpb.DirectSubjectSet{}},
+		},
+	}, nil
+}
+
+func (fakeSpicedb) ReadSchema(context.Context, *authzedpb.ReadSchemaRequest) (*authzedpb.ReadSchemaResponse, error) {
+	return &authzedpb.ReadSchemaResponse{ReadAt: zedToken, SchemaText: "definition user {}"}, nil
+}
+
+func (fakeSpicedb) ReflectSchema(context.Context, *authzedpb.ReflectSchemaRequest) (*authzedpb.ReflectSchemaResponse, error) {
+	return &authzedpb.ReflectSchemaResponse{
+		ReadAt:      zedToken,
+		Definitions: []*authzedpb.ReflectionDefinition{{Name: "user"}},
+	}, nil
+}
+
+var startOnce sync.Once
+
+// startFakeSpicedb registers the builtins and starts the plugin connected to a fake SpiceDB, once per test binary.
+func startFakeSpicedb(t *testing.T) {
+	t.Helper()
+
+	startOnce.Do(func() {
+		serve := func(fake fakeSpicedb) string {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := grpc.NewServer()
+			authzedpb.RegisterPermissionsServiceServer(server, fake)
+			authzedpb.RegisterSchemaServiceServer(server, fake)
+			go server.Serve(listener)
+			return listener.Addr().String()
+		}
+		primary, replica := serve(fakeSpicedb{}), serve(fakeSpicedb{replica: true})
+
+		manager, err := plugins.New([]byte(`{}`), "test", inmem.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := authzed.Factory{}.Validate(manager, []byte(`{"write_endpoint": "`+primary+`", "read_endpoint": "`+replica+`",
+			"insecure": true, "token": "test", "cache": {"ttl": {"default": "1m"}}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (authzed.Factory{}).New(manager, config).Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		Register()
+	})
+}
+
+func TestBuiltinsEval(t *testing.T) {
+	startFakeSpicedb(t)
+
+	calls := map[string]string{
+		"check_permission":       `"document", "doc1", "view", "user", "alice"`,
+		"check_bulk_permissions": `[{"resourceType": "document", "resourceId": "doc1", "permission": "view", "subjectType": "user", "subjectId": "alice"}]`,
+		"lookup_resources":       `"document", "view", "user", "alice"`,
+		"lookup_subjects":        `"document", "doc1", "view", "user"`,
+		"write_relationships":    `[{"resourceType": "document", "resourceId": "doc1", "relationship": "viewer", "subjectType": "user", "subjectId": "alice"}], [], []`,
+		"read_relationships":     `"document", "doc1", "", "", ""`,
+		"delete_relationships":   `"document", "doc1", "viewer", "user", "alice"`,
+		"expand_permission_tree": `"document", "doc1", "view"`,
+		"read_schema":            ``,
+		"reflect_schema":         ``,
+	}
+
+	for builtin, args := range calls {
+		options := `{"consistency": "fully_consistent"}`
+		if !slices.Contains(builtinOptions[builtin], "consistency") {
+			options = `{"connection": "default"}`
+		}
+
+		for _, query := range []string{
+			"x := spicedb." + builtin + "(" + args + ")",
+			"x := spicedb." + builtin + "_with_options(" + args + withSeparator(args) + options + ")",
+		} {
+			t.Run(query, func(t *testing.T) {
+				rs, err := rego.New(rego.Query(query)).Eval(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(rs) != 1 {
+					t.Fatalf("expected one result, got %v", rs)
+				}
+
+				result, ok := rs[0].Bindings["x"].(map[string]any)
+				if !ok {
+					t.Fatalf("expected an object, got %v", rs[0].Bindings["x"])
+				}
+				if _, failed := result["error"]; failed {
+					t.Fatalf("expected a successful result, got %v", result)
+				}
+			})
+		}
+	}
+}
+
+// withSeparator returns the separator between the regular arguments and the options object.
+func withSeparator(args string) string {
+	if args == "" {
+		return ""
+	}
+	return ", "
+}
+
+func TestFullyConsistentSkipsSharedCache(t *testing.T) {
+	startFakeSpicedb(t)
+
+	eval := func(query string) {
+		t.Helper()
+		if _, err := rego.New(rego.Query(query)).Eval(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		consistency string
+		calls       int64
+	}{
+		{"minimize_latency", 1},
+		{"fully_consistent", 2},
+	}
+
+	for _, test := range tests {
+		before := checkPermissionCalls.Load()
+		query := `x := spicedb.check_permission_with_options("document", "cached", "view", "user", "alice", {"consistency": "` + test.consistency + `"})`
+		eval(query)
+		eval(query)
+
+		if calls := checkPermissionCalls.Load() - before; calls != test.calls {
+			t.Errorf("%s: expected %d requests, got %d", test.consistency, test.calls, calls)
+		}
+	}
+}
+
+func TestReplicaFallsBackToPrimary(t *testing.T) {
+	startFakeSpicedb(t)
+
+	tests := []struct {
+		consistency string
+		result      bool
+	}{
+		{`"minimize_latency"`, false},             // served by the replica
+		{`{"at_least_as_fresh": "token"}`, false}, // the replica knows the token
+		{`{"at_least_as_fresh": "newer"}`, true},  // the replica lags behind, the primary answers
+		{`{"at_exact_snapshot": "newer"}`, false}, // the replica answers the snapshot it has
+	}
+
+	for _, test := range tests {
+		query := `x := spicedb.check_permission_with_options("document", "replicated", "view", "user", "alice", {"consistency": ` + test.consistency + `})`
+		rs, err := rego.New(rego.Query(query)).Eval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := rs[0].Bindings["x"].(map[string]any)
+		if result["result"] != test.result {
+			t.Errorf("%s: expected result %v, got %v", test.consistency, test.result, result)
+		}
+	}
+}
+
+func TestLookupSubjectsConditionalWildcard(t *testing.T) {
+	startFakeSpicedb(t)
+
+	rs, err := rego.New(rego.Query(`x := spicedb.lookup_subjects("document", "caveated", "view", "user")`)).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := rs[0].Bindings["x"].(map[string]any)
+
+	expected := map[string]any{
+		"subjectIds":          []any{"alice"},
+		"wildcard":            false,
+		"conditionalWildcard": map[string]any{"missingRequiredContext": []any{"ip"}},
+		"excludedSubjectIds":  []any{"bob"},
+		"conditionalSubjects": []any{map[string]any{"subjectId": "carol", "missingRequiredContext": []any{"ip"}}},
+	}
+	for field, value := range expected {
+		if !reflect.DeepEqual(result[field], value) {
+			t.Errorf("expected %s %v, got %v", field, value, result[field])
+		}
+	}
+}
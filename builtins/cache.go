@@ -0,0 +1,99 @@
+package builtins
+
+import (
+	"fmt"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"strings"
+)
+
+// queryCacheKey is the key of a result in the query cache: the builtin cache key on the connection and
+// schema prefix it was fetched with.
+type queryCacheKey struct {
+	connection   string
+	schemaprefix string
+	key          any
+}
+
+// sharedCacheKey renders a typed builtin cache key for the cache shared across queries of a connection.
+// The schema prefix is part of the key, as results are returned without it.
+func sharedCacheKey(target target, key any) string {
+	return fmt.Sprintf("%s|%T:%v", target.schemaprefix, key, key)
+}
+
+// cachedBuiltin returns the name of the builtin caching under the key, to look up its TTL.
+func cachedBuiltin(key any) string {
+	switch key := key.(type) {
+	case checkPermissionCacheKeyType:
+		return "check_permission"
+	case lookupResourcesCacheKeyType:
+		return "lookup_resources"
+	case lookupSubjectsCacheKeyType:
+		return "lookup_subjects"
+	case ReadRelationshipsCacheKeyType:
+		return "read_relationships"
+	case expandPermissionTreeCacheKeyType:
+		return "expand_permission_tree"
+	case schemaCacheKeyType:
+		if strings.HasPrefix(string(key), "read_schema") {
+			return "read_schema"
+		}
+		return "reflect_schema"
+	}
+	return "default"
+}
+
+// cacheGet looks up a result in the query cache, then in the cache shared across queries of the connection.
+// Fully consistent requests skip the shared cache. The returned generation must be passed to cachePut.
+func cacheGet(bctx rego.BuiltinContext, target target, key any) (ast.Value, uint64, bool) {
+	queryKey := queryCacheKey{target.connection.Name, target.schemaprefix, key}
+	if cached, found := bctx.Cache.Get(queryKey); found {
+		return cached.(ast.Value), 0, true
+	}
+	if !target.shared {
+		return nil, 0, false
+	}
+
+	cached, generation, found := target.connection.CacheGet(sharedCacheKey(target, key))
+	if found {
+		bctx.Cache.Put(queryKey, cached)
+		return cached.(ast.Value), generation, true
+	}
+
+	return nil, generation, false
+}
+
+// cachePut stores a result in the query cache and the cache shared across queries of the connection.
+// The scope is the prefixed resource type of the relationships the result depends on,
+// authzed.ScopeAll for computed permissions or authzed.ScopeSchema for schema results.
+// Negative results, i.e. denied checks and empty lookups, may be cached for a shorter time.
+// Results of fully consistent requests are only cached for the query.
+func cachePut(bctx rego.BuiltinContext, target target, key any, value ast.Value, scope string, negative bool, generation uint64) {
+	bctx.Cache.Put(queryCacheKey{target.connection.Name, target.schemaprefix, key}, value)
+	if !target.shared {
+		return
+	}
+	shared := sharedCacheKey(target, key)
+	target.connection.CachePut(shared, cachedBuiltin(key), value, scope, int64(len(shared)+len(value.String())), negative, generation)
+}
+
+// cacheEvict removes the results depending on relationships of the given resource types after relationships
+// were written or deleted, from the query cache and the cache shared across queries of the connection.
+func cacheEvict(bctx rego.BuiltinContext, target target, resourceTypes ...string) {
+	for key := range bctx.Cache {
+		queryKey, ok := key.(queryCacheKey)
+		if !ok || queryKey.connection != target.connection.Name {
+			continue
+		}
+		if _, schema := queryKey.key.(schemaCacheKeyType); !schema {
+			// schema results don't depend on relationships
+			delete(bctx.Cache, key)
+		}
+	}
+
+	objectTypes := make([]string, 0, len(resourceTypes))
+	for _, resourceType := range resourceTypes {
+		objectTypes = append(objectTypes, target.schemaprefix+resourceType)
+	}
+	target.connection.CacheEvict(objectTypes...)
+}
@@ -0,0 +1,181 @@
+package builtins
+
+import (
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"google.golang.org/grpc/codes"
+)
+
+var checkBulkPermissionsBuiltinDecl = &rego.Function{
+	Name: "spicedb.check_bulk_permissions",
+	Decl: types.NewFunction(
+		types.Args(
+			types.Named("checks",
+				types.NewAny(
+					types.NewArray(nil, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+					types.NewSet(types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+				),
+			),
+		),
+		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))), // Returns a structure
+	Nondeterministic: true,
+}
+
+type checkItemStruct struct {
+	ResourceType    string `json:"resourceType"`
+	ResourceId      string `json:"resourceId"`
+	Permission      string `json:"permission"`
+	SubjectType     string `json:"subjectType"`
+	SubjectId       string `json:"subjectId"`
+	SubjectRelation string `json:"subjectRelation"`
+}
+
+type checkBulkResult struct {
+	Token  ZedToken `json:"checkedAt"`
+	Result bool     `json:"result"`
+}
+
+// checkBulkPermissionsBuiltinImpl checks a list of permission requests against spicedb within a single request.
+// The per item results are keyed by "resourceType:resourceId#permission@subjectType:subjectId[#subjectRelation]".
+func checkBulkPermissionsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+	var error_result ErrorStruct
+
+	// extract parameters
+	array, err := convertToArray(terms[0])
+	if err != nil {
+		return renderErr(err), nil
+	}
+
+	var checks []checkItemStruct
+	if err := ast.As(array, &checks); err != nil {
+		return renderErr(err), nil
+	}
+
+	opts, err := optionsFromTerms(terms, 1, "check_bulk_permissions")
+	if err != nil {
+		return renderErr(err), nil
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := ast.NewObject()
+
+	// collect items not yet cached, every key is only requested once
+	var keys []string
+	var generation uint64
+	var items []*authzedpb.CheckBulkPermissionsRequestItem
+	requested := make(map[string]bool)
+
+	for _, check := range checks {
+		if check.ResourceType == "" || check.ResourceId == "" || check.Permission == "" || check.SubjectType == "" || check.SubjectId == "" {
+			return renderErr(fmt.Errorf("incomplete check item: '%v'", check)), nil
+		}
+
+		key := checkPermissionKey(check.ResourceType, check.ResourceId, check.Permission, check.SubjectType, check.SubjectId, check.SubjectRelation)
+
+		// Check if it is already cached, in this query or across queries.
+		cached, itemGeneration, ok := cacheGet(bctx, target, checkPermissionCacheKeyType(key+opts.cacheKey()))
+		if ok {
+			results.Insert(ast.StringTerm(key), ast.NewTerm(cached))
+			continue
+		}
+		if len(keys) == 0 {
+			// the generation before the request is valid for all items
+			generation = itemGeneration
+		}
+
+		if requested[key] {
+			continue
+		}
+		requested[key] = true
+
+		keys = append(keys, key)
+		items = append(items, &authzedpb.CheckBulkPermissionsRequestItem{
+			Resource: &authzedpb.ObjectReference{
+				ObjectType: target.schemaprefix + check.ResourceType,
+				ObjectId:   check.ResourceId,
+			},
+			Permission: check.Permission,
+			Subject: &authzedpb.SubjectReference{Object: &authzedpb.ObjectReference{
+				ObjectType: target.schemaprefix + check.SubjectType,
+				ObjectId:   check.SubjectId,
+			}, OptionalRelation: check.SubjectRelation},
+			Context: opts.context,
+		})
+	}
+
+	var token string
+
+	if len(items) > 0 {
+		consistency := target.connection.ReadConsistency(opts.consistency)
+		ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestCheck)
+		defer cancel()
+
+		resp, err := readWithFallback(target.connection, consistency, func(client *authzedclient.Client) (*authzedpb.CheckBulkPermissionsResponse, error) {
+			return client.CheckBulkPermissions(ctx, &authzedpb.CheckBulkPermissionsRequest{
+				Consistency: consistency,
+				Items:       items,
+			})
+		})
+
+		if err != nil {
+			error_result = newErrorStruct(err)
+
+			var error_term, _ = ast.InterfaceToValue(error_result)
+
+			return ast.NewTerm(error_term), nil
+		}
+
+		// extract ZedToken
+		token = resp.CheckedAt.Token
+		zedtoken := ZedToken(token)
+
+		// pairs are returned in the order of the request items
+		for i, pair := range resp.Pairs {
+			if i >= len(keys) {
+				break
+			}
+
+			if pairError := pair.GetError(); pairError != nil {
+				item_error := ErrorStruct{codes.Code(pairError.Code).String(), pairError.Message, statusCodeName(codes.Code(pairError.Code))}
+				error_term, err := ast.InterfaceToValue(item_error)
+				if err != nil {
+					return nil, err
+				}
+				// errors are not cached
+				results.Insert(ast.StringTerm(keys[i]), ast.NewTerm(error_term))
+				continue
+			}
+
+			item := pair.GetItem()
+
+			term, err := ast.InterfaceToValue(newCheckResult(zedtoken, item.GetPermissionship(), item.GetPartialCaveatInfo()))
+			if err != nil {
+				return nil, err
+			}
+			// share the result with spicedb.check_permission
+			negative := item.GetPermissionship() == authzedpb.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION
+			cachePut(bctx, target, checkPermissionCacheKeyType(keys[i]+opts.cacheKey()), term, authzed.ScopeAll, negative, generation)
+
+			results.Insert(ast.StringTerm(keys[i]), ast.NewTerm(term))
+		}
+	}
+
+	// construct result structure
+	result, err := ast.InterfaceToValue(checkBulkResult{ZedToken(token), true})
+	if err != nil {
+		return nil, err
+	}
+	result.(ast.Object).Insert(ast.StringTerm("results"), ast.NewTerm(results))
+
+	return ast.NewTerm(result), nil
+}
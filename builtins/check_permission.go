@@ -1,13 +1,12 @@
 package builtins
 
 import (
-	"errors"
 	"fmt"
 	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/types"
-	"google.golang.org/grpc/status"
 	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
 )
 
@@ -23,8 +22,49 @@ var checkPermissionBuiltinDecl = &rego.Function{
 type checkPermissionCacheKeyType string
 
 type checkResult struct {
-	Token  ZedToken `json:"lookedUpAt"`
-	Result bool     `json:"result"`
+	Token             ZedToken           `json:"lookedUpAt"`
+	Result            bool               `json:"result"`
+	Permissionship    string             `json:"permissionship"`
+	PartialCaveatInfo *partialCaveatInfo `json:"partialCaveatInfo,omitempty"`
+}
+
+type partialCaveatInfo struct {
+	MissingRequiredContext []string `json:"missingRequiredContext"`
+}
+
+// newCheckResult maps a check response onto the tri-state result: has_permission, no_permission or conditional.
+// Only has_permission sets result to true, conditional results report the missing caveat context.
+func newCheckResult(token ZedToken, permissionship authzedpb.CheckPermissionResponse_Permissionship, caveatInfo *authzedpb.PartialCaveatInfo) checkResult {
+	result := checkResult{Token: token}
+
+	switch permissionship {
+	case authzedpb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION:
+		result.Result = true
+		result.Permissionship = "has_permission"
+	case authzedpb.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION:
+		result.Permissionship = "no_permission"
+	case authzedpb.CheckPermissionResponse_PERMISSIONSHIP_CONDITIONAL_PERMISSION:
+		result.Permissionship = "conditional"
+		result.PartialCaveatInfo = &partialCaveatInfo{MissingRequiredContext: make([]string, 0)}
+		if caveatInfo != nil {
+			result.PartialCaveatInfo.MissingRequiredContext = append(result.PartialCaveatInfo.MissingRequiredContext, caveatInfo.MissingRequiredContext...)
+		}
+	default:
+		result.Permissionship = "unspecified"
+	}
+
+	return result
+}
+
+// checkPermissionKey renders a single permission check in the form used as cache key and as
+// index of the spicedb.check_bulk_permissions results.
+// Userset subjects are rendered with their relation, e.g. "document:doc1#view@group:eng#member".
+func checkPermissionKey(resourceType, resourceId, permission, subjectType, subjectId, subjectRelation string) string {
+	key := fmt.Sprintf("%s:%s#%s@%s:%s", resourceType, resourceId, permission, subjectType, subjectId)
+	if subjectRelation != "" {
+		key += "#" + subjectRelation
+	}
+	return key
 }
 
 // checkPermissionBuiltinImpl checks the given permission requests against spicedb.
@@ -54,43 +94,50 @@ func checkPermissionBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*a
 		return nil, err
 	}
 
-	// Check if it is already cached, assume they never become invalid.
-	var cacheKey = checkPermissionCacheKeyType(fmt.Sprintf("%s:%s#%s@%s:%s", resourceType, resourceId, permission, subjectType, subjectId))
-	cached, ok := bctx.Cache.Get(cacheKey)
+	opts, err := optionsFromTerms(terms, 5, "check_permission")
+	if err != nil {
+		return nil, err
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = checkPermissionCacheKeyType(checkPermissionKey(resourceType, resourceId, permission, subjectType, subjectId, opts.subjectRelation) + opts.cacheKey())
+	cached, generation, ok := cacheGet(bctx, target, cacheKey)
 	if ok {
-		return ast.NewTerm(cached.(ast.Value)), nil
+		return ast.NewTerm(cached), nil
 	}
 
 	subjectReference := &authzedpb.SubjectReference{Object: &authzedpb.ObjectReference{
-		ObjectType: authzed.Schemaprefix + subjectType,
+		ObjectType: target.schemaprefix + subjectType,
 		ObjectId:   subjectId,
-	}}
+	}, OptionalRelation: opts.subjectRelation}
 
 	resourceReference := &authzedpb.ObjectReference{
-		ObjectType: authzed.Schemaprefix + resourceType,
+		ObjectType: target.schemaprefix + resourceType,
 		ObjectId:   resourceId,
 	}
 
-	client := authzed.GetAuthzedClient()
-	if client == nil {
-		return nil, errors.New("authzed client not configured")
-	}
-
-	resp, err := client.CheckPermission(bctx.Context, &authzedpb.CheckPermissionRequest{
-		Resource:   resourceReference,
-		Permission: permission,
-		Subject:    subjectReference,
+	consistency := target.connection.ReadConsistency(opts.consistency)
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestCheck)
+	defer cancel()
+
+	resp, err := readWithFallback(target.connection, consistency, func(client *authzedclient.Client) (*authzedpb.CheckPermissionResponse, error) {
+		return client.CheckPermission(ctx, &authzedpb.CheckPermissionRequest{
+			Consistency: consistency,
+			Resource:    resourceReference,
+			Permission:  permission,
+			Subject:     subjectReference,
+			Context:     opts.context,
+		})
 	})
 
 	if err != nil { // error condition seems NOT to catch issues with the write request
-		// extract if gRPC error
-		if s, ok := status.FromError(err); ok {
-			// Extract code & description
-			error_result = ErrorStruct{s.Code().String(), s.Message()}
-		} else {
-			var errorstring = fmt.Sprintf("%s", err)
-			error_result = ErrorStruct{"Error", errorstring}
-		}
+		error_result = newErrorStruct(err)
 
 		var error_term, _ = ast.InterfaceToValue(error_result)
 
@@ -101,14 +148,12 @@ func checkPermissionBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*a
 	var token string = resp.CheckedAt.Token
 	zedtoken := ZedToken(token)
 
-	var has_permissionship bool = resp.Permissionship == authzedpb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
-
-	result := checkResult{zedtoken, has_permissionship}
+	result := newCheckResult(zedtoken, resp.Permissionship, resp.PartialCaveatInfo)
 	term, err := ast.InterfaceToValue(result)
 	if err != nil {
 		return nil, err
 	}
-	bctx.Cache.Put(cacheKey, term)
+	cachePut(bctx, target, cacheKey, term, authzed.ScopeAll, resp.Permissionship == authzedpb.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION, generation)
 
 	return ast.NewTerm(term), nil
 }
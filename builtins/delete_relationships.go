@@ -1,7 +1,6 @@
 package builtins
 
 import (
-	"errors"
 	"fmt"
 	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
 	"github.com/open-policy-agent/opa/ast"
@@ -22,9 +21,6 @@ var DeleteRelationshipsBuiltinDecl = &rego.Function{
 		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))), // Returns a ObjectType
 }
 
-// Use a custom cache key type to avoid collisions with other builtins caching data!!
-type DeleteRelationshipsCacheKeyType string
-
 // LookupResourcesBuiltinImpl checks the given permission requests against spicedb.
 func DeleteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
 
@@ -56,66 +52,40 @@ func DeleteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term)
 		return nil, err
 	}
 
-	// Check if it is already cached, assume they never become invalid.
-	var cacheKey = DeleteRelationshipsCacheKeyType(fmt.Sprintf("%s:#%s@%s:%s", resourceType, resourceId, relationship, subjectType, subjectId))
-	cached, found := bctx.Cache.Get(cacheKey)
-	if found {
-		return ast.NewTerm(cached.(ast.Value)), nil
+	opts, err := optionsFromTerms(terms, 5, "delete_relationships")
+	if err != nil {
+		return nil, err
 	}
 
-	// construct query element: SubjectFilter
-
-	var subjectFilter *authzedpb.SubjectFilter
-	//  	fmt.Println ("## 1>", subjectFilter)
-	if subjectType != "" {
-		subjectFilter = &authzedpb.SubjectFilter{
-			SubjectType: authzed.Schemaprefix + subjectType,
-			//OptionalSubjectId:   subjectId,
-			// OptionalRelation: ...
-		}
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
 	}
-	if subjectType != "" && subjectId != "" {
-		subjectFilter = &authzedpb.SubjectFilter{
-			SubjectType:       authzed.Schemaprefix + subjectType,
-			OptionalSubjectId: subjectId,
-			// OptionalRelation: ...
-		}
 
-	}
+	// deletions are never cached, every call is sent to spicedb
 
 	// construct query element: RelationshipFilter
+	relationshipFilter := newRelationshipFilter(target.schemaprefix, resourceType, resourceId, relationship, subjectType, subjectId, opts.subjectRelation)
 
-	relationshipFilter := &authzedpb.RelationshipFilter{
-		ResourceType: authzed.Schemaprefix + resourceType,
-	}
-	if resourceId != "" {
-		relationshipFilter.OptionalResourceId = resourceId
-	}
-	if subjectFilter != nil {
-		relationshipFilter.OptionalSubjectFilter = subjectFilter
-	}
-
-	if relationship != "" {
-		relationshipFilter.OptionalRelation = relationship
-	}
-
-	// get client
-	client := authzed.GetAuthzedClient()
-	if client == nil {
-		return nil, errors.New("authzed client not configured")
-	}
+	client := target.connection.Client()
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestDelete)
+	defer cancel()
 
 	// do query
-	resp, err := client.DeleteRelationships(bctx.Context, &authzedpb.DeleteRelationshipsRequest{
+	resp, err := client.DeleteRelationships(ctx, &authzedpb.DeleteRelationshipsRequest{
 		RelationshipFilter: relationshipFilter,
 	})
 
 	if err != nil {
-		var error_term, _ = ast.InterfaceToValue(err)
+		var error_term, _ = ast.InterfaceToValue(newErrorStruct(err))
 		return ast.NewTerm(error_term), nil
 
 	}
 
+	// the deleted relationships invalidate cached results
+	cacheEvict(bctx, target, resourceType)
+
 	token := resp.DeletedAt.Token
 
 	result := deleteRelationshipsResult{
@@ -128,8 +98,6 @@ func DeleteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term)
 		return nil, err
 	}
 
-	bctx.Cache.Put(cacheKey, term)
-	//
 	return ast.NewTerm(term), nil
 
 }
@@ -0,0 +1,175 @@
+package builtins
+
+import (
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"strings"
+)
+
+type expandPermissionTreeResult struct {
+	Result bool            `json:"result"`
+	Token  ZedToken        `json:"expandedAt"`
+	Tree   *permissionTree `json:"tree"`
+}
+
+// permissionTree is a node of an expanded permission: either an operation (union, intersection, exclusion)
+// on its children, or a leaf with the subjects directly related to the expanded object.
+type permissionTree struct {
+	ResourceType string           `json:"resourceType"`
+	ResourceId   string           `json:"resourceId"`
+	Relation     string           `json:"relation"`
+	Operation    string           `json:"operation,omitempty"`
+	Children     []permissionTree `json:"children,omitempty"`
+	Subjects     []treeSubject    `json:"subjects,omitempty"`
+}
+
+type treeSubject struct {
+	SubjectType     string `json:"subjectType"`
+	SubjectId       string `json:"subjectId"`
+	SubjectRelation string `json:"subjectRelation,omitempty"`
+}
+
+var expandPermissionTreeBuiltinDecl = &rego.Function{
+	Name: "spicedb.expand_permission_tree",
+	Decl: types.NewFunction(
+		types.Args(types.S, types.S, types.S),                             // resourceType, resourceId, permission
+		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))), // Returns a ObjectType
+	Nondeterministic: true,
+}
+
+// Use a custom cache key type to avoid collisions with other builtins caching data!!
+type expandPermissionTreeCacheKeyType string
+
+// convertPermissionTree converts an expanded tree into its rego representation, removing the schema prefix.
+// Nodes and subjects of other schema prefixes are left out.
+func convertPermissionTree(node *authzedpb.PermissionRelationshipTree, schemaprefix string) (permissionTree, bool) {
+	if !strings.HasPrefix(node.ExpandedObject.GetObjectType(), schemaprefix) {
+		return permissionTree{}, false
+	}
+
+	tree := permissionTree{
+		ResourceType: strings.TrimPrefix(node.ExpandedObject.GetObjectType(), schemaprefix),
+		ResourceId:   node.ExpandedObject.GetObjectId(),
+		Relation:     node.ExpandedRelation,
+	}
+
+	if intermediate := node.GetIntermediate(); intermediate != nil {
+		switch intermediate.Operation {
+		case authzedpb.AlgebraicSubjectSet_OPERATION_UNION:
+			tree.Operation = "union"
+		case authzedpb.AlgebraicSubjectSet_OPERATION_INTERSECTION:
+			tree.Operation = "intersection"
+		case authzedpb.AlgebraicSubjectSet_OPERATION_EXCLUSION:
+			tree.Operation = "exclusion"
+		default:
+			tree.Operation = "unspecified"
+		}
+
+		tree.Children = make([]permissionTree, 0, len(intermediate.Children))
+		for _, child := range intermediate.Children {
+			if child, ok := convertPermissionTree(child, schemaprefix); ok {
+				tree.Children = append(tree.Children, child)
+			}
+		}
+	}
+
+	if leaf := node.GetLeaf(); leaf != nil {
+		tree.Subjects = make([]treeSubject, 0, len(leaf.Subjects))
+		for _, subject := range leaf.Subjects {
+			if !strings.HasPrefix(subject.Object.GetObjectType(), schemaprefix) {
+				continue
+			}
+			tree.Subjects = append(tree.Subjects, treeSubject{
+				SubjectType:     strings.TrimPrefix(subject.Object.GetObjectType(), schemaprefix),
+				SubjectId:       subject.Object.GetObjectId(),
+				SubjectRelation: subject.OptionalRelation,
+			})
+		}
+	}
+
+	return tree, true
+}
+
+// expandPermissionTreeBuiltinImpl expands the given permission of a resource into its tree of subject sets.
+func expandPermissionTreeBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+
+	// extract parameters
+	var resourceType, resourceId, permission string
+
+	if err := ast.As(terms[0].Value, &resourceType); err != nil {
+		return nil, err
+	}
+
+	if err := ast.As(terms[1].Value, &resourceId); err != nil {
+		return nil, err
+	}
+
+	if err := ast.As(terms[2].Value, &permission); err != nil {
+		return nil, err
+	}
+
+	opts, err := optionsFromTerms(terms, 3, "expand_permission_tree")
+	if err != nil {
+		return nil, err
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = expandPermissionTreeCacheKeyType(fmt.Sprintf("%s:%s#%s", resourceType, resourceId, permission) + opts.cacheKey())
+	cached, generation, found := cacheGet(bctx, target, cacheKey)
+	if found {
+		return ast.NewTerm(cached), nil
+	}
+
+	consistency := target.connection.ReadConsistency(opts.consistency)
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestLookup)
+	defer cancel()
+
+	// do query
+	resp, err := readWithFallback(target.connection, consistency, func(client *authzedclient.Client) (*authzedpb.ExpandPermissionTreeResponse, error) {
+		return client.ExpandPermissionTree(ctx, &authzedpb.ExpandPermissionTreeRequest{
+			Consistency: consistency,
+			Resource: &authzedpb.ObjectReference{
+				ObjectType: target.schemaprefix + resourceType,
+				ObjectId:   resourceId,
+			},
+			Permission: permission,
+		})
+	})
+
+	if err != nil {
+		error_result := newErrorStruct(err)
+
+		var error_term, _ = ast.InterfaceToValue(error_result)
+		return ast.NewTerm(error_term), nil
+	}
+
+	result := expandPermissionTreeResult{
+		Result: true,
+		Token:  ZedToken(resp.ExpandedAt.GetToken()),
+	}
+	if resp.TreeRoot != nil {
+		if tree, ok := convertPermissionTree(resp.TreeRoot, target.schemaprefix); ok {
+			result.Tree = &tree
+		}
+	}
+
+	// Convert the result into an AST Term
+	term, err := ast.InterfaceToValue(result)
+	if err != nil {
+		return nil, err
+	}
+	cachePut(bctx, target, cacheKey, term, authzed.ScopeAll, false, generation)
+
+	return ast.NewTerm(term), nil
+}
@@ -1,14 +1,18 @@
 package builtins
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/types"
 	"io"
 	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -22,11 +26,30 @@ type lookupResult struct {
 	Permission         string   `json:"permission"`
 	SubjectType        string   `json:"subjectType"`
 	SubjectId          string   `json:"subjectId"`
+	Cursor             string   `json:"cursor,omitempty"` // set if the limit was reached, to fetch the next page
 }
 
 type ErrorStruct struct {
 	Error string `json:"error"`
 	Desc  string `json:"desc"`
+	Code  string `json:"code,omitempty"` // canonical gRPC status name, e.g. FAILED_PRECONDITION
+}
+
+// statusCodeName returns the canonical name of a gRPC status code, e.g. FAILED_PRECONDITION.
+func statusCodeName(c codes.Code) string {
+	return rpccode.Code(c).String()
+}
+
+// newErrorStruct converts a failed request into the error object returned to policies. Exceeded timeouts
+// are reported with code DEADLINE_EXCEEDED, whether the deadline was hit by gRPC or by the context.
+func newErrorStruct(err error) ErrorStruct {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		err = status.FromContextError(err).Err()
+	}
+	if s, ok := status.FromError(err); ok {
+		return ErrorStruct{s.Code().String(), s.Message(), statusCodeName(s.Code())}
+	}
+	return ErrorStruct{"Error", fmt.Sprintf("%s", err), ""}
 }
 
 var lookupResourcesBuiltinDecl = &rego.Function{
@@ -61,40 +84,58 @@ func lookupResourcesBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*a
 		return nil, err
 	}
 
-	// Check if it is already cached, assume they never become invalid.
-	var cacheKey = lookupResourcesCacheKeyType(fmt.Sprintf("%s:?#%s@%s:%s", resourceType, permission, subjectType, subjectId))
-	cached, found := bctx.Cache.Get(cacheKey)
+	opts, err := optionsFromTerms(terms, 4, "lookup_resources")
+	if err != nil {
+		return nil, err
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = lookupResourcesCacheKeyType(fmt.Sprintf("%s:?#%s@%s:%s#%s", resourceType, permission, subjectType, subjectId, opts.subjectRelation) + opts.cacheKey())
+	cached, generation, found := cacheGet(bctx, target, cacheKey)
 	if found {
-		return ast.NewTerm(cached.(ast.Value)), nil
+		return ast.NewTerm(cached), nil
 	}
 
 	// construct query element: subjectReference
 	subjectReference := &authzedpb.SubjectReference{Object: &authzedpb.ObjectReference{
-		ObjectType: authzed.Schemaprefix + subjectType,
+		ObjectType: target.schemaprefix + subjectType,
 		ObjectId:   subjectId,
-	}}
+	}, OptionalRelation: opts.subjectRelation}
 
-	// get client
-	client := authzed.GetAuthzedClient()
-	if client == nil {
-		return nil, errors.New("authzed client not configured")
-	}
+	consistency := target.connection.ReadConsistency(opts.consistency)
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestLookup)
+	defer cancel()
 
 	// do query
-	resp, err := client.LookupResources(bctx.Context, &authzedpb.LookupResourcesRequest{
-		ResourceObjectType: authzed.Schemaprefix + resourceType,
-		Permission:         permission,
-		Subject:            subjectReference,
+	resp, err := openReadStream(target.connection, consistency, func(client *authzedclient.Client) (receiver[*authzedpb.LookupResourcesResponse], error) {
+		return client.LookupResources(ctx, &authzedpb.LookupResourcesRequest{
+			Consistency:        consistency,
+			ResourceObjectType: target.schemaprefix + resourceType,
+			Permission:         permission,
+			Subject:            subjectReference,
+			Context:            opts.context,
+			OptionalLimit:      opts.limit,
+			OptionalCursor:     opts.cursor,
+		})
 	})
 
-	if err != nil {
-		return nil, err
+	if err != nil { // the stream could not be opened, e.g. the circuit breaker is open
+		var error_term, _ = ast.InterfaceToValue(newErrorStruct(err))
+		return ast.NewTerm(error_term), nil
 	}
 
 	var has_permissionship bool
 	var resourceIds []string = make([]string, 0)
 	var token string
 	var error_result ErrorStruct
+	var received uint32
+	var cursor string
 
 	// result is a stream, fetch elements
 	for {
@@ -105,18 +146,14 @@ func lookupResourcesBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*a
 		}
 
 		if err != nil { // result is an error
-			// extract if gRPC error
-			if s, ok := status.FromError(err); ok {
-				// Extract code & description
-				error_result = ErrorStruct{s.Code().String(), s.Message()}
-			} else {
-				var errorstring = fmt.Sprintf("%s", err)
-				error_result = ErrorStruct{"Error", errorstring}
-			}
+			error_result = newErrorStruct(err)
 			// don't continue on errors
 			break
 		}
 
+		received++
+		cursor = result.AfterResultCursor.GetToken()
+
 		has_permissionship = result.Permissionship == authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION
 		if !has_permissionship == true { // skip if no permission
 			continue
@@ -140,13 +177,17 @@ func lookupResourcesBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*a
 	zedtoken := ZedToken(token)
 	// construct result structure
 
-	result := lookupResult{true, zedtoken, resourceIds, resourceType, permission, subjectType, subjectId}
+	result := lookupResult{true, zedtoken, resourceIds, resourceType, permission, subjectType, subjectId, ""}
+	if opts.limit > 0 && received == opts.limit {
+		// the page is full, there might be more results
+		result.Cursor = cursor
+	}
 	// Convert the result into an AST Term
 	term, err := ast.InterfaceToValue(result)
 	if err != nil {
 		return nil, err
 	}
-	bctx.Cache.Put(cacheKey, term)
+	cachePut(bctx, target, cacheKey, term, authzed.ScopeAll, len(resourceIds) == 0, generation)
 
 	return ast.NewTerm(term), nil
 
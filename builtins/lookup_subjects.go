@@ -1,27 +1,44 @@
 package builtins
 
 import (
-	"errors"
 	"fmt"
 	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/types"
-	"google.golang.org/grpc/status"
 	"io"
 	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
 )
 
 type lookupSubjectsResult struct {
-	Result             bool     `json:"result"`
-	Token              ZedToken `json:"lookedUpAt"`
-	ResourceObjectId   string   `json:"resourceId"`
-	ResourceObjectType string   `json:"resourceType"`
-	Permission         string   `json:"permission"`
-	SubjectType        string   `json:"subjectType"`
-	SubjectIds         []string `json:"subjectIds"`
+	Result              bool                 `json:"result"`
+	Token               ZedToken             `json:"lookedUpAt"`
+	ResourceObjectId    string               `json:"resourceId"`
+	ResourceObjectType  string               `json:"resourceType"`
+	Permission          string               `json:"permission"`
+	SubjectType         string               `json:"subjectType"`
+	SubjectIds          []string             `json:"subjectIds"`
+	Wildcard            bool                 `json:"wildcard"`
+	ExcludedSubjectIds  []string             `json:"excludedSubjectIds"`
+	ConditionalSubjects []conditionalSubject `json:"conditionalSubjects"`
+	ConditionalWildcard *conditionalWildcard `json:"conditionalWildcard,omitempty"`
 }
 
+// conditionalSubject is a subject whose permission depends on a caveat with missing context.
+type conditionalSubject struct {
+	SubjectId              string   `json:"subjectId"`
+	MissingRequiredContext []string `json:"missingRequiredContext"`
+}
+
+// conditionalWildcard is a wildcard grant depending on a caveat with missing context.
+type conditionalWildcard struct {
+	MissingRequiredContext []string `json:"missingRequiredContext"`
+}
+
+// wildcardSubjectId is the subject id SpiceDB reports for wildcard grants like `user:*`.
+const wildcardSubjectId = "*"
+
 var lookupSubjectsBuiltinDecl = &rego.Function{
 	Name: "spicedb.lookup_subjects",
 	Decl: types.NewFunction(
@@ -54,38 +71,56 @@ func lookupSubjectsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*as
 		return nil, err
 	}
 
+	opts, err := optionsFromTerms(terms, 4, "lookup_subjects")
+	if err != nil {
+		return nil, err
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// construct query element: resourceReference
 	ResourceReference := &authzedpb.ObjectReference{
-		ObjectType: authzed.Schemaprefix + resourceType,
+		ObjectType: target.schemaprefix + resourceType,
 		ObjectId:   resourceId,
 	}
 
-	// Check if it is already cached, assume they never become invalid.
-	var cacheKey = lookupSubjectsCacheKeyType(fmt.Sprintf("%s:%s#%s@%s:?", resourceType, resourceId, permission, subjectType))
-	cached, found := bctx.Cache.Get(cacheKey)
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = lookupSubjectsCacheKeyType(fmt.Sprintf("%s:%s#%s@%s:?#%s", resourceType, resourceId, permission, subjectType, opts.subjectRelation) + opts.cacheKey())
+	cached, generation, found := cacheGet(bctx, target, cacheKey)
 	if found {
-		return ast.NewTerm(cached.(ast.Value)), nil
+		return ast.NewTerm(cached), nil
 	}
 
-	// get client
-	client := authzed.GetAuthzedClient()
-	if client == nil {
-		return nil, errors.New("authzed client not configured")
-	}
+	consistency := target.connection.ReadConsistency(opts.consistency)
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestLookup)
+	defer cancel()
 
 	// do query
-	resp, err := client.LookupSubjects(bctx.Context, &authzedpb.LookupSubjectsRequest{
-		Resource:          ResourceReference,
-		Permission:        permission,
-		SubjectObjectType: authzed.Schemaprefix + subjectType,
+	resp, err := openReadStream(target.connection, consistency, func(client *authzedclient.Client) (receiver[*authzedpb.LookupSubjectsResponse], error) {
+		return client.LookupSubjects(ctx, &authzedpb.LookupSubjectsRequest{
+			Consistency:             consistency,
+			Resource:                ResourceReference,
+			Permission:              permission,
+			SubjectObjectType:       target.schemaprefix + subjectType,
+			OptionalSubjectRelation: opts.subjectRelation,
+			Context:                 opts.context,
+		})
 	})
 
-	if err != nil {
-		return nil, err
+	if err != nil { // the stream could not be opened, e.g. the circuit breaker is open
+		var error_term, _ = ast.InterfaceToValue(newErrorStruct(err))
+		return ast.NewTerm(error_term), nil
 	}
 
-	var has_permissionship bool
 	var subjectIds []string = make([]string, 0)
+	var excludedSubjectIds []string = make([]string, 0)
+	var conditionalSubjects []conditionalSubject = make([]conditionalSubject, 0)
+	var wildcard bool
+	var wildcardCondition *conditionalWildcard
 	var token string
 	var error_result ErrorStruct
 
@@ -98,25 +133,45 @@ func lookupSubjectsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*as
 		}
 
 		if err != nil { // result is an error
-			// extract if gRPC error
-			if s, ok := status.FromError(err); ok {
-				// Extract code & description
-				error_result = ErrorStruct{s.Code().String(), s.Message()}
-			} else {
-				var errorstring = fmt.Sprintf("%s", err)
-				error_result = ErrorStruct{"Error", errorstring}
-			}
+			error_result = newErrorStruct(err)
 			// don't continue on errors
 			break
 		}
 
-		has_permissionship = result.Permissionship == authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION
-		if !has_permissionship == true { // skip if no permission
+		subject := result.Subject
+		if subject == nil {
 			continue
 		}
 
-		// append resourceId
-		subjectIds = append(subjectIds, result.SubjectObjectId)
+		missingRequiredContext := make([]string, 0)
+		if subject.PartialCaveatInfo != nil {
+			missingRequiredContext = append(missingRequiredContext, subject.PartialCaveatInfo.MissingRequiredContext...)
+		}
+
+		isWildcard := subject.SubjectObjectId == wildcardSubjectId
+		switch subject.Permissionship {
+		case authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION:
+			if isWildcard {
+				wildcard = true
+			} else {
+				subjectIds = append(subjectIds, subject.SubjectObjectId)
+			}
+		case authzedpb.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION:
+			if isWildcard {
+				wildcardCondition = &conditionalWildcard{MissingRequiredContext: missingRequiredContext}
+			} else {
+				conditionalSubjects = append(conditionalSubjects, conditionalSubject{SubjectId: subject.SubjectObjectId, MissingRequiredContext: missingRequiredContext})
+			}
+		default: // skip if no permission
+			continue
+		}
+
+		// subjects excluded from a wildcard grant, e.g. `user:* - user:bob`, are reported with the wildcard
+		if isWildcard {
+			for _, excluded := range result.ExcludedSubjects {
+				excludedSubjectIds = append(excludedSubjectIds, excluded.SubjectObjectId)
+			}
+		}
 
 		if token == "" { // save token
 			token = result.LookedUpAt.Token
@@ -134,13 +189,25 @@ func lookupSubjectsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*as
 
 	// construct result structure
 
-	result := lookupSubjectsResult{true, zedtoken, resourceType, resourceId, permission, subjectType, subjectIds}
+	result := lookupSubjectsResult{
+		Result:              true,
+		Token:               zedtoken,
+		ResourceObjectId:    resourceId,
+		ResourceObjectType:  resourceType,
+		Permission:          permission,
+		SubjectType:         subjectType,
+		SubjectIds:          subjectIds,
+		Wildcard:            wildcard,
+		ExcludedSubjectIds:  excludedSubjectIds,
+		ConditionalSubjects: conditionalSubjects,
+		ConditionalWildcard: wildcardCondition,
+	}
 	// Convert the result into an AST Term
 	term, err := ast.InterfaceToValue(result)
 	if err != nil {
 		return nil, err
 	}
-	bctx.Cache.Put(cacheKey, term)
+	cachePut(bctx, target, cacheKey, term, authzed.ScopeAll, len(subjectIds) == 0 && !wildcard && len(conditionalSubjects) == 0 && wildcardCondition == nil, generation)
 
 	return ast.NewTerm(term), nil
 
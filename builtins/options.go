@@ -0,0 +1,287 @@
+package builtins
+
+import (
+	"encoding/json"
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"math"
+	"slices"
+	"strings"
+)
+
+// requestOptions holds the optional parameters passed to the "_with_options" variants of the builtins.
+type requestOptions struct {
+	consistency     *authzedpb.Consistency
+	consistencyKey  string
+	context         *structpb.Struct
+	contextKey      string
+	subjectRelation string
+	preconditions   []preconditionStruct
+	limit           uint32
+	cursor          *authzedpb.Cursor
+	connection      string
+	schemaprefix    *string
+}
+
+// target is the connection a builtin call is sent to, together with the schema prefix applied to its types.
+type target struct {
+	connection   *authzed.Connection
+	schemaprefix string
+	shared       bool // results may be served from the cache shared across queries, unless fully consistent
+}
+
+// resolveTarget selects the connection and the schema prefix of a builtin call.
+func resolveTarget(opts requestOptions) (target, error) {
+	connection, err := authzed.GetConnection(opts.connection)
+	if err != nil {
+		return target{}, err
+	}
+
+	schemaprefix, err := connection.SelectSchemaprefix(opts.schemaprefix)
+	if err != nil {
+		return target{}, err
+	}
+
+	return target{connection, schemaprefix, !opts.consistency.GetFullyConsistent()}, nil
+}
+
+// withOptions derives the "_with_options" variant of a builtin declaration, accepting an additional options object.
+func withOptions(decl *rego.Function) *rego.Function {
+	args := append(decl.Decl.NamedFuncArgs().Args,
+		types.Named("options", types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+	)
+
+	return &rego.Function{
+		Name:             decl.Name + "_with_options",
+		Decl:             types.NewFunction(args, decl.Decl.Result()),
+		Nondeterministic: decl.Nondeterministic,
+	}
+}
+
+// withArgs drops the output term OPA passes after the arguments when the result of a call is assigned,
+// so optionsFromTerms only sees the options object of the "_with_options" variants.
+func withArgs(decl *rego.Function, impl rego.BuiltinDyn) (*rego.Function, rego.BuiltinDyn) {
+	n := len(decl.Decl.FuncArgs().Args)
+	return decl, func(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+		if len(terms) > n {
+			terms = terms[:n]
+		}
+		return impl(bctx, terms)
+	}
+}
+
+// builtinOptions lists the options each builtin accepts, besides connection and schemaprefix accepted by all builtins.
+var builtinOptions = map[string][]string{
+	"check_permission":       {"consistency", "context", "subjectRelation"},
+	"check_bulk_permissions": {"consistency", "context"},
+	"lookup_resources":       {"consistency", "context", "subjectRelation", "limit", "cursor"},
+	"lookup_subjects":        {"consistency", "context", "subjectRelation"},
+	"read_relationships":     {"consistency", "subjectRelation", "limit", "cursor"},
+	"write_relationships":    {"preconditions"},
+	"delete_relationships":   {"subjectRelation"},
+	"expand_permission_tree": {"consistency"},
+	"read_schema":            {},
+	"reflect_schema":         {"consistency"},
+}
+
+// optionsFromTerms parses the options object of the builtin following the first n regular arguments, if present.
+func optionsFromTerms(terms []*ast.Term, n int, builtin string) (requestOptions, error) {
+	if len(terms) <= n {
+		return parseRequestOptions(nil, builtin)
+	}
+	return parseRequestOptions(terms[n], builtin)
+}
+
+// parseRequestOptions converts an options object of the builtin into requestOptions, rejecting unknown keys
+// and options the builtin doesn't support.
+func parseRequestOptions(term *ast.Term, builtin string) (requestOptions, error) {
+	opts := requestOptions{consistencyKey: "minimize_latency"}
+
+	if term == nil {
+		return opts, nil
+	}
+
+	obj, ok := term.Value.(ast.Object)
+	if !ok {
+		return opts, fmt.Errorf("expected options object, got %v", term.Value)
+	}
+
+	for _, key := range obj.Keys() {
+		name, ok := key.Value.(ast.String)
+		if !ok {
+			return opts, fmt.Errorf("invalid option key: %v", key)
+		}
+
+		value := obj.Get(key)
+
+		if name != "connection" && name != "schemaprefix" && isOption(string(name)) && !slices.Contains(builtinOptions[builtin], string(name)) {
+			return opts, fmt.Errorf("option '%s' is not supported by spicedb.%s", string(name), builtin)
+		}
+
+		switch string(name) {
+		case "consistency":
+			consistency, consistencyKey, err := parseConsistency(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.consistency = consistency
+			opts.consistencyKey = consistencyKey
+		case "context":
+			if _, ok := value.Value.(ast.Object); !ok {
+				return opts, fmt.Errorf("expected caveat context object, got %v", value.Value)
+			}
+			context, err := ast.JSON(value.Value)
+			if err != nil {
+				return opts, err
+			}
+			if opts.context, err = toStruct(context); err != nil {
+				return opts, err
+			}
+			// encoding/json sorts the keys, which makes it a stable cache key
+			contextKey, _ := json.Marshal(context)
+			opts.contextKey = string(contextKey)
+		case "subjectRelation":
+			if err := ast.As(value.Value, &opts.subjectRelation); err != nil {
+				return opts, fmt.Errorf("invalid subjectRelation: %v", value.Value)
+			}
+		case "preconditions":
+			preconditions, err := parsePreconditions(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.preconditions = preconditions
+		case "connection":
+			if err := ast.As(value.Value, &opts.connection); err != nil {
+				return opts, fmt.Errorf("invalid connection: %v", value.Value)
+			}
+		case "schemaprefix":
+			var schemaprefix string
+			if err := ast.As(value.Value, &schemaprefix); err != nil {
+				return opts, fmt.Errorf("invalid schemaprefix: %v", value.Value)
+			}
+			opts.schemaprefix = &schemaprefix
+		case "limit":
+			var limit int
+			if err := ast.As(value.Value, &limit); err != nil || limit <= 0 || limit > math.MaxUint32 {
+				return opts, fmt.Errorf("invalid limit: %v", value.Value)
+			}
+			opts.limit = uint32(limit)
+		case "cursor":
+			var cursor string
+			if err := ast.As(value.Value, &cursor); err != nil {
+				return opts, fmt.Errorf("invalid cursor: %v", value.Value)
+			}
+			if cursor != "" {
+				opts.cursor = &authzedpb.Cursor{Token: cursor}
+			}
+		default:
+			return opts, fmt.Errorf("unknown option: '%s'", name)
+		}
+	}
+
+	return opts, nil
+}
+
+// isOption reports whether any builtin accepts the option, unknown options are reported as such.
+func isOption(name string) bool {
+	for _, supported := range builtinOptions {
+		if slices.Contains(supported, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey renders the options influencing a result, to be appended to the builtin cache keys.
+func (o requestOptions) cacheKey() string {
+	key := "|" + o.consistencyKey
+	if o.contextKey != "" {
+		key += "|" + o.contextKey
+	}
+	if o.limit > 0 {
+		key += fmt.Sprintf("|limit=%d", o.limit)
+	}
+	if o.cursor != nil {
+		key += "|cursor=" + o.cursor.Token
+	}
+	return key
+}
+
+// toStruct converts a JSON compatible value into a protobuf struct, e.g. to be passed as caveat context.
+func toStruct(value any) (*structpb.Struct, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &structpb.Struct{}
+	if err := protojson.Unmarshal(encoded, result); err != nil {
+		return nil, fmt.Errorf("invalid caveat context: %w", err)
+	}
+
+	return result, nil
+}
+
+// parseConsistency accepts
+//   - "minimize_latency"
+//   - "fully_consistent"
+//   - "at_least_as_fresh:<token>" or {"at_least_as_fresh": "<token>"}
+//   - "at_exact_snapshot:<token>" or {"at_exact_snapshot": "<token>"}
+//
+// and returns the consistency requirement together with its canonical form.
+func parseConsistency(term *ast.Term) (*authzedpb.Consistency, string, error) {
+	var mode, token string
+
+	switch v := term.Value.(type) {
+	case ast.Null:
+		return nil, "minimize_latency", nil
+	case ast.String:
+		mode, token, _ = strings.Cut(string(v), ":")
+	case ast.Object:
+		if v.Len() != 1 {
+			return nil, "", fmt.Errorf("invalid consistency: %v", v)
+		}
+		key := v.Keys()[0]
+		if err := ast.As(key.Value, &mode); err != nil {
+			return nil, "", fmt.Errorf("invalid consistency: %v", v)
+		}
+		if err := ast.As(v.Get(key).Value, &token); err != nil {
+			return nil, "", fmt.Errorf("invalid consistency token: %v", v)
+		}
+	default:
+		return nil, "", fmt.Errorf("invalid consistency: %v", term.Value)
+	}
+
+	switch mode {
+	case "", "minimize_latency":
+		return &authzedpb.Consistency{
+			Requirement: &authzedpb.Consistency_MinimizeLatency{MinimizeLatency: true},
+		}, "minimize_latency", nil
+	case "fully_consistent":
+		return &authzedpb.Consistency{
+			Requirement: &authzedpb.Consistency_FullyConsistent{FullyConsistent: true},
+		}, "fully_consistent", nil
+	case "at_least_as_fresh":
+		if token == "" {
+			return nil, "", fmt.Errorf("consistency '%s' requires a token", mode)
+		}
+		return &authzedpb.Consistency{
+			Requirement: &authzedpb.Consistency_AtLeastAsFresh{AtLeastAsFresh: &authzedpb.ZedToken{Token: token}},
+		}, mode + ":" + token, nil
+	case "at_exact_snapshot":
+		if token == "" {
+			return nil, "", fmt.Errorf("consistency '%s' requires a token", mode)
+		}
+		return &authzedpb.Consistency{
+			Requirement: &authzedpb.Consistency_AtExactSnapshot{AtExactSnapshot: &authzedpb.ZedToken{Token: token}},
+		}, mode + ":" + token, nil
+	}
+
+	return nil, "", fmt.Errorf("unknown consistency: '%s'", mode)
+}
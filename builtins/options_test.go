@@ -0,0 +1,85 @@
+package builtins
+
+import (
+	"testing"
+
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/open-policy-agent/opa/ast"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseConsistency(t *testing.T) {
+	minimizeLatency := &authzedpb.Consistency{Requirement: &authzedpb.Consistency_MinimizeLatency{MinimizeLatency: true}}
+	fullyConsistent := &authzedpb.Consistency{Requirement: &authzedpb.Consistency_FullyConsistent{FullyConsistent: true}}
+	atLeastAsFresh := &authzedpb.Consistency{Requirement: &authzedpb.Consistency_AtLeastAsFresh{AtLeastAsFresh: &authzedpb.ZedToken{Token: "abc"}}}
+	atExactSnapshot := &authzedpb.Consistency{Requirement: &authzedpb.Consistency_AtExactSnapshot{AtExactSnapshot: &authzedpb.ZedToken{Token: "abc"}}}
+
+	tests := []struct {
+		term        string
+		consistency *authzedpb.Consistency
+		key         string
+	}{
+		{`null`, nil, "minimize_latency"},
+		{`"minimize_latency"`, minimizeLatency, "minimize_latency"},
+		{`"fully_consistent"`, fullyConsistent, "fully_consistent"},
+		{`"at_least_as_fresh:abc"`, atLeastAsFresh, "at_least_as_fresh:abc"},
+		{`{"at_least_as_fresh": "abc"}`, atLeastAsFresh, "at_least_as_fresh:abc"},
+		{`"at_exact_snapshot:abc"`, atExactSnapshot, "at_exact_snapshot:abc"},
+		{`{"at_exact_snapshot": "abc"}`, atExactSnapshot, "at_exact_snapshot:abc"},
+	}
+
+	for _, test := range tests {
+		consistency, key, err := parseConsistency(ast.MustParseTerm(test.term))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.term, err)
+			continue
+		}
+		if !proto.Equal(consistency, test.consistency) || key != test.key {
+			t.Errorf("%s: expected %v %q, got %v %q", test.term, test.consistency, test.key, consistency, key)
+		}
+	}
+}
+
+func TestParseConsistencyInvalid(t *testing.T) {
+	for _, term := range []string{
+		`"at_least_as_fresh"`,
+		`{"at_exact_snapshot": ""}`,
+		`"eventually"`,
+		`{"at_least_as_fresh": "abc", "fully_consistent": true}`,
+		`{"at_least_as_fresh": 1}`,
+		`42`,
+	} {
+		if _, _, err := parseConsistency(ast.MustParseTerm(term)); err == nil {
+			t.Errorf("%s: expected an error", term)
+		}
+	}
+}
+
+func TestParseRequestOptionsPerBuiltin(t *testing.T) {
+	tests := []struct {
+		builtin string
+		options string
+		valid   bool
+	}{
+		{"check_permission", `{"consistency": "fully_consistent", "context": {"ip": "10.0.0.1"}, "subjectRelation": "member"}`, true},
+		{"lookup_resources", `{"context": {"ip": "10.0.0.1"}, "limit": 10, "cursor": "abc"}`, true},
+		{"write_relationships", `{"preconditions": [], "connection": "eu", "schemaprefix": "tenant_a/"}`, true},
+		{"read_schema", `{"connection": "eu"}`, true},
+		{"check_permission", `{"limit": 10}`, false},
+		{"read_relationships", `{"context": {"ip": "10.0.0.1"}}`, false},
+		{"write_relationships", `{"consistency": "fully_consistent"}`, false},
+		{"delete_relationships", `{"consistency": "fully_consistent"}`, false},
+		{"read_schema", `{"consistency": "fully_consistent"}`, false},
+		{"expand_permission_tree", `{"unknown": true}`, false},
+	}
+
+	for _, test := range tests {
+		_, err := parseRequestOptions(ast.MustParseTerm(test.options), test.builtin)
+		if test.valid && err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.builtin, test.options, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s %s: expected an error", test.builtin, test.options)
+		}
+	}
+}
@@ -1,30 +1,24 @@
 package builtins
 
 import (
-	"errors"
 	"fmt"
 	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/types"
-	"google.golang.org/grpc/status"
-	"io"
-	"strings"
 	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"io"
 )
 
-type Relationship struct {
-	ResourceType string `json:"resourceType"`
-	ResourceId   string `json:"resourceId"`
-	Relationship string `json:"relationship"`
-	SubjectType  string `json:"subjectType"`
-	SubjectId    string `json:"subjectId"`
-}
+// Relationship is the shape of relationships in read results, shared with the mirror in data.spicedb.
+type Relationship = authzed.Relationship
 
 type readRelationshipsResult struct {
 	Result        bool           `json:"result"`
 	Token         ZedToken       `json:"lookedUpAt"`
 	Relationships []Relationship `json:"relationships"`
+	Cursor        string         `json:"cursor,omitempty"` // set if the limit was reached, to fetch the next page
 }
 
 var ReadRelationshipsBuiltinDecl = &rego.Function{
@@ -34,6 +28,29 @@ var ReadRelationshipsBuiltinDecl = &rego.Function{
 		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))), // Returns a ObjectType
 }
 
+// newRelationshipFilter constructs a RelationshipFilter, empty optional parts are left unset.
+// A subject id or relation is only applied together with a subject type. Types are prefixed with the schema prefix.
+func newRelationshipFilter(schemaprefix, resourceType, resourceId, relation, subjectType, subjectId, subjectRelation string) *authzedpb.RelationshipFilter {
+	relationshipFilter := &authzedpb.RelationshipFilter{
+		ResourceType:       schemaprefix + resourceType,
+		OptionalResourceId: resourceId,
+		OptionalRelation:   relation,
+	}
+
+	if subjectType != "" {
+		subjectFilter := &authzedpb.SubjectFilter{
+			SubjectType:       schemaprefix + subjectType,
+			OptionalSubjectId: subjectId,
+		}
+		if subjectRelation != "" {
+			subjectFilter.OptionalRelation = &authzedpb.SubjectFilter_RelationFilter{Relation: subjectRelation}
+		}
+		relationshipFilter.OptionalSubjectFilter = subjectFilter
+	}
+
+	return relationshipFilter
+}
+
 // Use a custom cache key type to avoid collisions with other builtins caching data!!
 type ReadRelationshipsCacheKeyType string
 
@@ -67,61 +84,44 @@ func ReadRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (
 		return nil, err
 	}
 
-	// Check if it is already cached, assume they never become invalid.
-	var cacheKey = ReadRelationshipsCacheKeyType(fmt.Sprintf("%s:#%s@%s:%s", resourceType, resourceId, permission, subjectType, subjectId))
-	cached, found := bctx.Cache.Get(cacheKey)
-	if found {
-		return ast.NewTerm(cached.(ast.Value)), nil
+	opts, err := optionsFromTerms(terms, 5, "read_relationships")
+	if err != nil {
+		return nil, err
 	}
 
-	// construct query element: SubjectFilter
-
-	var subjectFilter *authzedpb.SubjectFilter
-	if subjectType != "" {
-		subjectFilter = &authzedpb.SubjectFilter{
-			SubjectType: authzed.Schemaprefix + subjectType,
-			//OptionalSubjectId:   subjectId,
-			// OptionalRelation: ...
-		}
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
 	}
-	if subjectType != "" && subjectId != "" {
-		subjectFilter = &authzedpb.SubjectFilter{
-			SubjectType:       authzed.Schemaprefix + subjectType,
-			OptionalSubjectId: subjectId,
-			// OptionalRelation: ...
-		}
 
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = ReadRelationshipsCacheKeyType(fmt.Sprintf("%s:%s#%s@%s:%s#%s", resourceType, resourceId, permission, subjectType, subjectId, opts.subjectRelation) + opts.cacheKey())
+	cached, generation, found := cacheGet(bctx, target, cacheKey)
+	if found {
+		return ast.NewTerm(cached), nil
 	}
 
 	// construct query element: RelationshipFilter
+	relationshipFilter := newRelationshipFilter(target.schemaprefix, resourceType, resourceId, permission, subjectType, subjectId, opts.subjectRelation)
 
-	relationshipFilter := &authzedpb.RelationshipFilter{
-		ResourceType: authzed.Schemaprefix + resourceType,
-	}
-	if resourceId != "" {
-		relationshipFilter.OptionalResourceId = resourceId
-	}
-	if subjectFilter != nil {
-		relationshipFilter.OptionalSubjectFilter = subjectFilter
-	}
-
-	if permission != "" {
-		relationshipFilter.OptionalRelation = permission
-	}
-
-	// get client
-	client := authzed.GetAuthzedClient()
-	if client == nil {
-		return nil, errors.New("authzed client not configured")
-	}
+	consistency := target.connection.ReadConsistency(opts.consistency)
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestRead)
+	defer cancel()
 
 	// do query
-	resp, err := client.ReadRelationships(bctx.Context, &authzedpb.ReadRelationshipsRequest{
-		RelationshipFilter: relationshipFilter,
+	resp, err := openReadStream(target.connection, consistency, func(client *authzedclient.Client) (receiver[*authzedpb.ReadRelationshipsResponse], error) {
+		return client.ReadRelationships(ctx, &authzedpb.ReadRelationshipsRequest{
+			Consistency:        consistency,
+			RelationshipFilter: relationshipFilter,
+			OptionalLimit:      opts.limit,
+			OptionalCursor:     opts.cursor,
+		})
 	})
 
-	if err != nil {
-		return nil, err
+	if err != nil { // the stream could not be opened, e.g. the circuit breaker is open
+		var error_term, _ = ast.InterfaceToValue(newErrorStruct(err))
+		return ast.NewTerm(error_term), nil
 	}
 
 	var readResult = readRelationshipsResult{
@@ -129,6 +129,8 @@ func ReadRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (
 	}
 	var token string
 	var error_result ErrorStruct
+	var received uint32
+	var cursor string
 
 	// result is a stream, fetch elements
 	for {
@@ -139,25 +141,20 @@ func ReadRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (
 		}
 
 		if err != nil { // result is an error
-			// extract if gRPC error
-			if s, ok := status.FromError(err); ok {
-				// Extract code & description
-				error_result = ErrorStruct{s.Code().String(), s.Message()}
-			} else {
-				var errorstring = fmt.Sprintf("%s", err)
-				error_result = ErrorStruct{"Error", errorstring}
-			}
+			error_result = newErrorStruct(err)
 			// don't continue on errors
 			break
 		}
 
-		relation := Relationship{
-			ResourceType: strings.TrimPrefix(result.Relationship.Resource.ObjectType, authzed.Schemaprefix),
-			ResourceId:   result.Relationship.Resource.ObjectId,
-			Relationship: result.Relationship.Relation,
-			SubjectType:  strings.TrimPrefix(result.Relationship.Subject.Object.ObjectType, authzed.Schemaprefix),
-			SubjectId:    result.Relationship.Subject.Object.ObjectId,
+		received++
+		cursor = result.AfterResultCursor.GetToken()
+
+		if !authzed.InSchemaprefix(result.Relationship, target.schemaprefix) {
+			// subjects of other schema prefixes are not returned
+			continue
 		}
+
+		relation := authzed.NewRelationship(result.Relationship, target.schemaprefix)
 		// append resourceId
 		readResult.Relationships = append(readResult.Relationships, relation)
 
@@ -175,13 +172,18 @@ func ReadRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (
 	// extract ZedToken
 	readResult.Token = ZedToken(token)
 
+	if opts.limit > 0 && received == opts.limit {
+		// the page is full, there might be more results
+		readResult.Cursor = cursor
+	}
+
 	// Convert the result into an AST Term
 	term, err := ast.InterfaceToValue(readResult)
 	if err != nil {
 		return nil, err
 	}
 
-	bctx.Cache.Put(cacheKey, term)
+	cachePut(bctx, target, cacheKey, term, target.schemaprefix+resourceType, len(readResult.Relationships) == 0, generation)
 
 	return ast.NewTerm(term), nil
 
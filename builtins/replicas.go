@@ -0,0 +1,70 @@
+package builtins
+
+import (
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// receiver is the receiving side of a server stream.
+type receiver[T any] interface {
+	Recv() (T, error)
+}
+
+// requiresFreshness reports whether the consistency carries a zedtoken a read replica may not have caught up with.
+func requiresFreshness(consistency *authzedpb.Consistency) bool {
+	return consistency.GetAtLeastAsFresh() != nil || consistency.GetAtExactSnapshot() != nil
+}
+
+// fallbackToPrimary reports whether a read failed on a replica because its zedtoken is newer than the
+// replica's revision, spicedb rejects such tokens as out of range.
+func fallbackToPrimary(replica bool, consistency *authzedpb.Consistency, err error) bool {
+	return replica && requiresFreshness(consistency) && status.Code(err) == codes.OutOfRange
+}
+
+// readWithFallback sends a read to the read replicas of the connection, or to its primary endpoints if none
+// are configured. A read carrying a zedtoken the replicas don't know yet is repeated on the primary.
+func readWithFallback[T any](connection *authzed.Connection, consistency *authzedpb.Consistency, call func(client *authzedclient.Client) (T, error)) (T, error) {
+	client, replica := connection.ReadClient()
+
+	resp, err := call(client)
+	if err != nil && fallbackToPrimary(replica, consistency, err) {
+		return call(connection.Client())
+	}
+	return resp, err
+}
+
+// openReadStream opens a streaming read like readWithFallback. The replicas report a zedtoken they don't
+// know with the first message, so it is received up front and replayed to the caller.
+func openReadStream[T any](connection *authzed.Connection, consistency *authzedpb.Consistency, open func(client *authzedclient.Client) (receiver[T], error)) (receiver[T], error) {
+	client, replica := connection.ReadClient()
+
+	stream, err := open(client)
+	if err != nil || !replica || !requiresFreshness(consistency) {
+		return stream, err
+	}
+
+	first, err := stream.Recv()
+	if err != nil && fallbackToPrimary(replica, consistency, err) {
+		return open(connection.Client())
+	}
+	return &replayStream[T]{receiver: stream, first: first, err: err}, nil
+}
+
+// replayStream returns the already received first message of a stream before receiving the rest.
+type replayStream[T any] struct {
+	receiver[T]
+	first    T
+	err      error
+	replayed bool
+}
+
+func (s *replayStream[T]) Recv() (T, error) {
+	if !s.replayed {
+		s.replayed = true
+		return s.first, s.err
+	}
+	return s.receiver.Recv()
+}
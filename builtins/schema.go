@@ -0,0 +1,417 @@
+package builtins
+
+import (
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	authzedclient "github.com/authzed/authzed-go/v1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"strings"
+)
+
+type readSchemaResult struct {
+	Result bool     `json:"result"`
+	Token  ZedToken `json:"readAt"`
+	Schema string   `json:"schema"`
+}
+
+type reflectSchemaResult struct {
+	Result      bool                         `json:"result"`
+	Token       ZedToken                     `json:"readAt"`
+	Definitions map[string]reflectDefinition `json:"definitions"`
+	Caveats     map[string]reflectCaveat     `json:"caveats"`
+}
+
+type reflectDefinition struct {
+	Name        string                       `json:"name"`
+	Comment     string                       `json:"comment"`
+	Relations   map[string]reflectRelation   `json:"relations"`
+	Permissions map[string]reflectPermission `json:"permissions"`
+}
+
+type reflectRelation struct {
+	Name         string               `json:"name"`
+	Comment      string               `json:"comment"`
+	SubjectTypes []reflectSubjectType `json:"subjectTypes"`
+}
+
+// reflectSubjectType is an allowed subject type of a relation, e.g. `user`, `group#member`, `user:*` or `user with caveat`.
+type reflectSubjectType struct {
+	SubjectType     string `json:"subjectType"`
+	SubjectRelation string `json:"subjectRelation,omitempty"`
+	Wildcard        bool   `json:"wildcard"`
+	CaveatName      string `json:"caveatName,omitempty"`
+}
+
+type reflectPermission struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+}
+
+type reflectCaveat struct {
+	Name       string            `json:"name"`
+	Comment    string            `json:"comment"`
+	Expression string            `json:"expression"`
+	Parameters map[string]string `json:"parameters"` // parameter name -> type
+}
+
+var readSchemaBuiltinDecl = &rego.Function{
+	Name: "spicedb.read_schema",
+	Decl: types.NewFunction(
+		types.Args(),
+		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))), // Returns a ObjectType
+	Nondeterministic: true,
+}
+
+var reflectSchemaBuiltinDecl = &rego.Function{
+	Name: "spicedb.reflect_schema",
+	Decl: types.NewFunction(
+		types.Args(),
+		types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))), // Returns a ObjectType
+	Nondeterministic: true,
+}
+
+// Use a custom cache key type to avoid collisions with other builtins caching data!!
+type schemaCacheKeyType string
+
+// filterSchemaText keeps the definitions and caveats of the schema prefix, together with their preceding comments,
+// and removes the prefix from the type names. Comments and caveat expressions are left unchanged.
+func filterSchemaText(schema, schemaprefix string) string {
+	if schemaprefix == "" {
+		return schema
+	}
+
+	var kept []string
+	for _, block := range splitSchemaBlocks(schema) {
+		keyword, name := schemaBlockName(block)
+		if keyword != "use" && !strings.HasPrefix(name, schemaprefix) {
+			continue
+		}
+
+		var text strings.Builder
+		replacing := true
+		for _, segment := range block {
+			if !segment.code || !replacing {
+				text.WriteString(segment.text)
+				continue
+			}
+			code := segment.text
+			if keyword == "caveat" {
+				// only the caveat name is a type name, the parameters and the expression follow it
+				if end := strings.Index(code, "("); end >= 0 {
+					text.WriteString(removeTypePrefix(code[:end], schemaprefix))
+					text.WriteString(code[end:])
+					replacing = false
+					continue
+				}
+			}
+			text.WriteString(removeTypePrefix(code, schemaprefix))
+		}
+		kept = append(kept, strings.TrimSpace(text.String()))
+	}
+
+	return strings.Join(kept, "\n\n")
+}
+
+// schemaSegment is a part of schema text: code, or a comment or string literal whose braces and
+// text don't belong to the schema structure.
+type schemaSegment struct {
+	text string
+	code bool
+}
+
+// splitSchemaBlocks splits schema text into its top level definitions, caveats and use directives (eg. use expiration),
+// each with its preceding comments.
+func splitSchemaBlocks(schema string) [][]schemaSegment {
+	var blocks [][]schemaSegment
+	var block []schemaSegment
+	depth, opened, start := 0, false, 0
+
+	flush := func(end int, code bool) {
+		if end > start {
+			block = append(block, schemaSegment{text: schema[start:end], code: code})
+		}
+		start = end
+	}
+
+	for i := 0; i < len(schema); i++ {
+		switch {
+		case strings.HasPrefix(schema[i:], "//"):
+			flush(i, true)
+			end := strings.IndexByte(schema[i:], '\n')
+			if end < 0 {
+				end = len(schema) - i
+			}
+			i += end - 1
+			flush(i+1, false)
+		case strings.HasPrefix(schema[i:], "/*"):
+			flush(i, true)
+			end := strings.Index(schema[i+2:], "*/")
+			if end < 0 {
+				end = len(schema) - i - 4
+			}
+			i += end + 3
+			flush(i+1, false)
+		case schema[i] == '"' || schema[i] == '\'':
+			flush(i, true)
+			quote := schema[i]
+			for i++; i < len(schema) && schema[i] != quote && schema[i] != '\n'; i++ {
+				if schema[i] == '\\' {
+					i++
+				}
+			}
+			flush(min(i+1, len(schema)), false)
+		case schema[i] == '\n' && !opened:
+			if isUseDirective(schema[strings.LastIndexByte(schema[:i], '\n')+1 : i]) {
+				flush(i+1, true)
+				blocks = append(blocks, block)
+				block = nil
+			}
+		case schema[i] == '{':
+			depth++
+			opened = true
+		case schema[i] == '}':
+			depth--
+			if opened && depth <= 0 {
+				// a definition or caveat is complete
+				flush(i+1, true)
+				blocks = append(blocks, block)
+				block, depth, opened = nil, 0, false
+			}
+		}
+	}
+
+	if !opened && isUseDirective(schema[strings.LastIndexByte(schema, '\n')+1:]) {
+		flush(len(schema), true)
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+// isUseDirective reports whether a line of schema text enables a feature, eg. use expiration.
+func isUseDirective(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) >= 2 && fields[0] == "use"
+}
+
+// schemaBlockName returns the keyword (definition, caveat or use) and the name declared in a block of schema text.
+func schemaBlockName(block []schemaSegment) (string, string) {
+	var code strings.Builder
+	for _, segment := range block {
+		if segment.code {
+			code.WriteString(segment.text)
+		}
+	}
+
+	fields := strings.Fields(code.String())
+	if len(fields) < 2 || (fields[0] != "definition" && fields[0] != "caveat" && fields[0] != "use") {
+		return "", ""
+	}
+	name := strings.FieldsFunc(fields[1], func(r rune) bool { return r == '{' || r == '(' })
+	if len(name) == 0 {
+		return fields[0], ""
+	}
+	return fields[0], name[0]
+}
+
+// removeTypePrefix removes the schema prefix from the type names in schema code: occurrences of the prefix
+// that start a name, not within another name.
+func removeTypePrefix(code, schemaprefix string) string {
+	var removed strings.Builder
+	for i := 0; i < len(code); i++ {
+		if strings.HasPrefix(code[i:], schemaprefix) && (i == 0 || !isSchemaNameChar(code[i-1])) {
+			i += len(schemaprefix) - 1
+			continue
+		}
+		removed.WriteByte(code[i])
+	}
+	return removed.String()
+}
+
+// isSchemaNameChar reports whether the character can be part of a (prefixed) type name.
+func isSchemaNameChar(c byte) bool {
+	return c == '_' || c == '/' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// readSchemaBuiltinImpl returns the schema text, with the schema prefix removed from all type names.
+func readSchemaBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+
+	opts, err := optionsFromTerms(terms, 0, "read_schema")
+	if err != nil {
+		return nil, err
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = schemaCacheKeyType("read_schema")
+	cached, generation, found := cacheGet(bctx, target, cacheKey)
+	if found {
+		return ast.NewTerm(cached), nil
+	}
+
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestRead)
+	defer cancel()
+
+	// do query
+	resp, err := readWithFallback(target.connection, nil, func(client *authzedclient.Client) (*authzedpb.ReadSchemaResponse, error) {
+		return client.ReadSchema(ctx, &authzedpb.ReadSchemaRequest{})
+	})
+
+	if err != nil {
+		error_result := newErrorStruct(err)
+
+		var error_term, _ = ast.InterfaceToValue(error_result)
+		return ast.NewTerm(error_term), nil
+	}
+
+	schema := filterSchemaText(resp.SchemaText, target.schemaprefix)
+
+	result := readSchemaResult{
+		Result: true,
+		Token:  ZedToken(resp.ReadAt.GetToken()),
+		Schema: schema,
+	}
+
+	// Convert the result into an AST Term
+	term, err := ast.InterfaceToValue(result)
+	if err != nil {
+		return nil, err
+	}
+	cachePut(bctx, target, cacheKey, term, authzed.ScopeSchema, false, generation)
+
+	return ast.NewTerm(term), nil
+}
+
+// reflectSchemaBuiltinImpl returns the structured schema: definitions with their relations and permissions, and caveats.
+// Only definitions and caveats of the configured schema prefix are returned, with the prefix removed.
+func reflectSchemaBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+
+	opts, err := optionsFromTerms(terms, 0, "reflect_schema")
+	if err != nil {
+		return nil, err
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if it is already cached, in this query or across queries.
+	var cacheKey = schemaCacheKeyType("reflect_schema" + opts.cacheKey())
+	cached, generation, found := cacheGet(bctx, target, cacheKey)
+	if found {
+		return ast.NewTerm(cached), nil
+	}
+
+	consistency := target.connection.ReadConsistency(opts.consistency)
+	request := &authzedpb.ReflectSchemaRequest{
+		Consistency: consistency,
+	}
+	if target.schemaprefix != "" {
+		request.OptionalFilters = []*authzedpb.ReflectionSchemaFilter{
+			{OptionalDefinitionNameFilter: target.schemaprefix},
+			{OptionalCaveatNameFilter: target.schemaprefix},
+		}
+	}
+
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestRead)
+	defer cancel()
+
+	// do query
+	resp, err := readWithFallback(target.connection, consistency, func(client *authzedclient.Client) (*authzedpb.ReflectSchemaResponse, error) {
+		return client.ReflectSchema(ctx, request)
+	})
+
+	if err != nil {
+		error_result := newErrorStruct(err)
+
+		var error_term, _ = ast.InterfaceToValue(error_result)
+		return ast.NewTerm(error_term), nil
+	}
+
+	result := reflectSchemaResult{
+		Result:      true,
+		Token:       ZedToken(resp.ReadAt.GetToken()),
+		Definitions: make(map[string]reflectDefinition),
+		Caveats:     make(map[string]reflectCaveat),
+	}
+
+	for _, definition := range resp.Definitions {
+		if !strings.HasPrefix(definition.Name, target.schemaprefix) {
+			continue
+		}
+
+		reflected := reflectDefinition{
+			Name:        strings.TrimPrefix(definition.Name, target.schemaprefix),
+			Comment:     definition.Comment,
+			Relations:   make(map[string]reflectRelation),
+			Permissions: make(map[string]reflectPermission),
+		}
+
+		for _, relation := range definition.Relations {
+			subjectTypes := make([]reflectSubjectType, 0)
+			for _, subjectType := range relation.SubjectTypes {
+				if !strings.HasPrefix(subjectType.SubjectDefinitionName, target.schemaprefix) {
+					continue
+				}
+				subjectTypes = append(subjectTypes, reflectSubjectType{
+					SubjectType:     strings.TrimPrefix(subjectType.SubjectDefinitionName, target.schemaprefix),
+					SubjectRelation: subjectType.GetOptionalRelationName(),
+					Wildcard:        subjectType.GetIsPublicWildcard(),
+					CaveatName:      strings.TrimPrefix(subjectType.OptionalCaveatName, target.schemaprefix),
+				})
+			}
+
+			reflected.Relations[relation.Name] = reflectRelation{
+				Name:         relation.Name,
+				Comment:      relation.Comment,
+				SubjectTypes: subjectTypes,
+			}
+		}
+
+		for _, permission := range definition.Permissions {
+			reflected.Permissions[permission.Name] = reflectPermission{
+				Name:    permission.Name,
+				Comment: permission.Comment,
+			}
+		}
+
+		result.Definitions[reflected.Name] = reflected
+	}
+
+	for _, caveat := range resp.Caveats {
+		if !strings.HasPrefix(caveat.Name, target.schemaprefix) {
+			continue
+		}
+
+		reflected := reflectCaveat{
+			Name:       strings.TrimPrefix(caveat.Name, target.schemaprefix),
+			Comment:    caveat.Comment,
+			Expression: caveat.Expression,
+			Parameters: make(map[string]string),
+		}
+
+		for _, parameter := range caveat.Parameters {
+			reflected.Parameters[parameter.Name] = parameter.Type
+		}
+
+		result.Caveats[reflected.Name] = reflected
+	}
+
+	// Convert the result into an AST Term
+	term, err := ast.InterfaceToValue(result)
+	if err != nil {
+		return nil, err
+	}
+	cachePut(bctx, target, cacheKey, term, authzed.ScopeSchema, false, generation)
+
+	return ast.NewTerm(term), nil
+}
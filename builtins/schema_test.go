@@ -0,0 +1,84 @@
+package builtins
+
+import (
+	"testing"
+)
+
+func TestFilterSchemaText(t *testing.T) {
+	schema := `use expiration
+
+/** the users of tenant_a/, {not a block */
+definition tenant_a/user {}
+
+// documents } of tenant_a/
+definition tenant_a/document {
+	relation viewer: tenant_a/user | tenant_a/user:* | tenant_a/group#member with tenant_a/in_office
+	permission view = viewer
+}
+
+definition tenant_b/user {}
+
+caveat tenant_a/in_office(ip ipaddress, label string) {
+	label != "tenant_a/{" && ip.in_cidr('10.0.0.0/8')
+}
+
+definition other_tenant_a/user {}`
+
+	expected := `use expiration
+
+/** the users of tenant_a/, {not a block */
+definition user {}
+
+// documents } of tenant_a/
+definition document {
+	relation viewer: user | user:* | group#member with in_office
+	permission view = viewer
+}
+
+caveat in_office(ip ipaddress, label string) {
+	label != "tenant_a/{" && ip.in_cidr('10.0.0.0/8')
+}`
+
+	if filtered := filterSchemaText(schema, "tenant_a/"); filtered != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, filtered)
+	}
+}
+
+func TestFilterSchemaTextUseDirectives(t *testing.T) {
+	tests := []struct {
+		schema   string
+		expected string
+	}{
+		{
+			"use expiration\n\ndefinition tenant_a/user {}\n\ndefinition tenant_a/doc {\n\trelation viewer: tenant_a/user with expiration\n}",
+			"use expiration\n\ndefinition user {}\n\ndefinition doc {\n\trelation viewer: user with expiration\n}",
+		},
+		{
+			"// features\nuse expiration\ndefinition tenant_b/user {}\ndefinition tenant_a/user {}",
+			"// features\nuse expiration\n\ndefinition user {}",
+		},
+		{
+			"definition tenant_a/user {}\nuse expiration",
+			"definition user {}\n\nuse expiration",
+		},
+	}
+
+	for _, test := range tests {
+		if filtered := filterSchemaText(test.schema, "tenant_a/"); filtered != test.expected {
+			t.Errorf("%q: expected:\n%s\ngot:\n%s", test.schema, test.expected, filtered)
+		}
+	}
+}
+
+func TestFilterSchemaTextInvalid(t *testing.T) {
+	for _, schema := range []string{
+		"definition {}",
+		"caveat (x int) { x > 1 }",
+		"definition tenant_a/user {",
+		"/* unterminated",
+		`caveat tenant_a/c(x string) { x == "unterminated }`,
+	} {
+		// must not panic
+		filterSchemaText(schema, "tenant_a/")
+	}
+}
@@ -0,0 +1,105 @@
+package builtins
+
+import (
+	"fmt"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
+	"strings"
+)
+
+// unavailableCodes are the error codes the on_unavailable policy applies to.
+var unavailableCodes = map[string]bool{
+	"UNAVAILABLE":       true,
+	"DEADLINE_EXCEEDED": true,
+}
+
+// withUnavailablePolicy applies the on_unavailable policy of the connection to a builtin: while spicedb is
+// unavailable, the error object is returned, replaced by {"result": false}, or by the last known result
+// marked with "stale": true and its age in seconds. The declaration is the one without options.
+func withUnavailablePolicy(decl *rego.Function, impl rego.BuiltinDyn) rego.BuiltinDyn {
+	builtin := strings.TrimPrefix(decl.Name, "spicedb.")
+	n := len(decl.Decl.FuncArgs().Args)
+
+	return func(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+		result, err := impl(bctx, terms)
+		if err != nil || result == nil {
+			return result, err
+		}
+
+		opts, err := optionsFromTerms(terms, n, builtin)
+		if err != nil {
+			return result, nil
+		}
+		target, err := resolveTarget(opts)
+		if err != nil {
+			return result, nil
+		}
+
+		policy := target.connection.OnUnavailable(builtin)
+		if policy == authzed.UnavailableError {
+			return result, nil
+		}
+
+		object, ok := result.Value.(ast.Object)
+		if !ok {
+			return result, nil
+		}
+
+		key := staleKey(builtin, target, terms, n)
+		if object.Get(ast.StringTerm("error")) == nil {
+			if policy == authzed.UnavailableStale {
+				target.connection.StalePut(key, result.Value)
+			}
+			return result, nil
+		}
+
+		code := object.Get(ast.StringTerm("code"))
+		if code == nil {
+			return result, nil
+		}
+		if name, ok := code.Value.(ast.String); !ok || !unavailableCodes[string(name)] {
+			return result, nil
+		}
+
+		switch policy {
+		case authzed.UnavailableDeny:
+			return ast.ObjectTerm(ast.Item(ast.StringTerm("result"), ast.BooleanTerm(false))), nil
+		case authzed.UnavailableStale:
+			stale, age, found := target.connection.StaleGet(key)
+			if !found {
+				return result, nil
+			}
+			marked := stale.(ast.Object).Copy()
+			marked.Insert(ast.StringTerm("stale"), ast.BooleanTerm(true))
+			marked.Insert(ast.StringTerm("age"), ast.IntNumberTerm(int(age.Seconds())))
+			return ast.NewTerm(marked), nil
+		}
+		return result, nil
+	}
+}
+
+// staleKey identifies a builtin call in the stale cache of the connection: the arguments and options,
+// except the consistency, on the schema prefix of the call.
+func staleKey(builtin string, target target, terms []*ast.Term, n int) string {
+	args := make([]string, 0, len(terms))
+	for _, term := range terms[:n] {
+		args = append(args, term.String())
+	}
+
+	if len(terms) > n {
+		if options, ok := terms[n].Value.(ast.Object); ok {
+			filtered := ast.NewObject()
+			options.Foreach(func(key, value *ast.Term) {
+				if !key.Equal(ast.StringTerm("consistency")) {
+					filtered.Insert(key, value)
+				}
+			})
+			if filtered.Len() > 0 {
+				args = append(args, filtered.String())
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s|%s(%s)", target.schemaprefix, builtin, strings.Join(args, ", "))
+}
@@ -1,14 +1,15 @@
 package builtins
 
 import (
-	"errors"
 	"fmt"
 	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/types"
 	authzed "github.com/umbrellaassociates/opa-spicedb/plugins/spicedb"
-	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strings"
+	"time"
 )
 
 type writeRelationshipsResult struct {
@@ -68,7 +69,7 @@ func convertToArray(term *ast.Term) (*ast.Array, error) {
 	return array, nil
 }
 
-func generateAuthzedOperationTupel(operationStr string, tupels []relationshipStruct) ([]*authzedpb.RelationshipUpdate, error) {
+func generateAuthzedOperationTupel(operationStr string, tupels []relationshipStruct, schemaprefix string) ([]*authzedpb.RelationshipUpdate, error) {
 	var updateRelationships []*authzedpb.RelationshipUpdate
 	var update_operation authzedpb.RelationshipUpdate_Operation
 
@@ -104,16 +105,16 @@ func generateAuthzedOperationTupel(operationStr string, tupels []relationshipStr
 		}
 
 		resourceReference := &authzedpb.ObjectReference{
-			ObjectType: authzed.Schemaprefix + update_tupel.ResourceType,
+			ObjectType: schemaprefix + update_tupel.ResourceType,
 			ObjectId:   update_tupel.ResourceId,
 		}
 
 		relationship := update_tupel.Relationship
 
 		subjectReference := &authzedpb.SubjectReference{Object: &authzedpb.ObjectReference{
-			ObjectType: authzed.Schemaprefix + update_tupel.SubjectType,
+			ObjectType: schemaprefix + update_tupel.SubjectType,
 			ObjectId:   update_tupel.SubjectId,
-		}}
+		}, OptionalRelation: update_tupel.SubjectRelation}
 
 
 		relationshipStruct := &authzedpb.Relationship{
@@ -122,6 +123,30 @@ func generateAuthzedOperationTupel(operationStr string, tupels []relationshipStr
 			Subject:  subjectReference,
 		}
 
+		if update_tupel.CaveatName != "" {
+			caveat := &authzedpb.ContextualizedCaveat{
+				CaveatName: schemaprefix + update_tupel.CaveatName,
+			}
+			if update_tupel.CaveatContext != nil {
+				context, err := toStruct(update_tupel.CaveatContext)
+				if err != nil {
+					return nil, err
+				}
+				caveat.Context = context
+			}
+			relationshipStruct.OptionalCaveat = caveat
+		} else if update_tupel.CaveatContext != nil {
+			return nil, fmt.Errorf("caveatContext without caveatName: '%v'", update_tupel)
+		}
+
+		if update_tupel.ExpiresAt != "" {
+			expiresAt, err := parseExpiresAt(update_tupel.ExpiresAt)
+			if err != nil {
+				return nil, err
+			}
+			relationshipStruct.OptionalExpiresAt = expiresAt
+		}
+
 		updateTupel := &authzedpb.RelationshipUpdate{
 			Operation:    update_operation,
 			Relationship: relationshipStruct,
@@ -134,23 +159,114 @@ func generateAuthzedOperationTupel(operationStr string, tupels []relationshipStr
 	return updateRelationships, nil
 }
 
+// parseExpiresAt accepts an absolute RFC3339 timestamp or a duration relative to now, e.g. "24h".
+func parseExpiresAt(expiresAt string) (*timestamppb.Timestamp, error) {
+	if timestamp, err := time.Parse(time.RFC3339, expiresAt); err == nil {
+		return timestamppb.New(timestamp), nil
+	}
+
+	duration, err := time.ParseDuration(expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("expiresAt is neither RFC3339 nor a duration: '%s'", expiresAt)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("expiresAt duration must be positive: '%s'", expiresAt)
+	}
+
+	return timestamppb.New(time.Now().Add(duration)), nil
+}
+
+type preconditionStruct struct {
+	Operation       string `json:"operation"`
+	ResourceType    string `json:"resourceType"`
+	ResourceId      string `json:"resourceId"`
+	Relationship    string `json:"relationship"`
+	SubjectType     string `json:"subjectType"`
+	SubjectId       string `json:"subjectId"`
+	SubjectRelation string `json:"subjectRelation"`
+}
+
+// parsePreconditions validates a list of relationship filters with operation must_match or must_not_match,
+// to be converted into write preconditions by newPreconditions.
+func parsePreconditions(term *ast.Term) ([]preconditionStruct, error) {
+	array, err := convertToArray(term)
+	if err != nil {
+		return nil, err
+	}
+
+	var preconditions []preconditionStruct
+	if err := ast.As(array, &preconditions); err != nil {
+		return nil, err
+	}
+
+	for i, precondition := range preconditions {
+		precondition.Operation = strings.ToUpper(precondition.Operation)
+		if precondition.Operation != "MUST_MATCH" && precondition.Operation != "MUST_NOT_MATCH" {
+			return nil, fmt.Errorf("precondition operation must be must_match or must_not_match: '%v'", precondition)
+		}
+
+		if precondition.ResourceType == "" {
+			return nil, fmt.Errorf("resoureType not set: '%v'", precondition)
+		}
+		preconditions[i] = precondition
+	}
+
+	return preconditions, nil
+}
+
+// newPreconditions converts validated preconditions into write preconditions, prefixing the types with the schema prefix.
+func newPreconditions(preconditions []preconditionStruct, schemaprefix string) []*authzedpb.Precondition {
+	var result []*authzedpb.Precondition
+	for _, precondition := range preconditions {
+		operation := authzedpb.Precondition_OPERATION_MUST_MATCH
+		if precondition.Operation == "MUST_NOT_MATCH" {
+			operation = authzedpb.Precondition_OPERATION_MUST_NOT_MATCH
+		}
+
+		result = append(result, &authzedpb.Precondition{
+			Operation: operation,
+			Filter: newRelationshipFilter(schemaprefix, precondition.ResourceType, precondition.ResourceId, precondition.Relationship,
+				precondition.SubjectType, precondition.SubjectId, precondition.SubjectRelation),
+		})
+	}
+
+	return result
+}
+
 func renderErr(err error) *ast.Term {
-	error_result := ErrorStruct{"Error", fmt.Sprintf("%s", err)}
+	error_result := ErrorStruct{"Error", fmt.Sprintf("%s", err), ""}
 	var error_term, _ = ast.InterfaceToValue(error_result)
 	return ast.NewTerm(error_term)
 }
 
 type relationshipStruct struct {
-	ResourceType string `json:"resourceType"`
-	ResourceId   string `json:"resourceId"`
-	Relationship string `json:"relationship"`
-	SubjectType  string `json:"subjectType"`
-	SubjectId    string `json:"subjectId"`
+	ResourceType    string         `json:"resourceType"`
+	ResourceId      string         `json:"resourceId"`
+	Relationship    string         `json:"relationship"`
+	SubjectType     string         `json:"subjectType"`
+	SubjectId       string         `json:"subjectId"`
+	SubjectRelation string         `json:"subjectRelation"`
+	CaveatName      string         `json:"caveatName"`
+	CaveatContext   map[string]any `json:"caveatContext"`
+	ExpiresAt       string         `json:"expiresAt"`
 }
 
 // WriteRelationshipsBuiltinImpl writes/updates a set of given relationships against spicedb.
-func WriteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, writesTerm, touchesTerm, deletesTerm *ast.Term) (*ast.Term, error) {
+// Failing preconditions are reported with code FAILED_PRECONDITION.
+func WriteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
 	var arrayTerm *ast.Array
+	writesTerm, touchesTerm, deletesTerm := terms[0], terms[1], terms[2]
+
+	opts, err := optionsFromTerms(terms, 3, "write_relationships")
+	if err != nil {
+		return renderErr(err), nil
+	}
+
+	// get connection and schema prefix
+	target, err := resolveTarget(opts)
+	if err != nil {
+		return nil, err
+	}
 
 	//
 	// convert writesTerm
@@ -167,7 +283,6 @@ func WriteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, writesTerm, touches
 		return renderErr(err), nil
 	}
 
-	fmt.Println(authzed.Schemaprefix)
 	//
 	// convert touchesTerm
 	// Ensure the argument is either an array or a set
@@ -199,19 +314,19 @@ func WriteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, writesTerm, touches
 	var error_result ErrorStruct
 
 	var updateRelationships []*authzedpb.RelationshipUpdate
-	updates, err := generateAuthzedOperationTupel("WRITE", writesRelStr)
+	updates, err := generateAuthzedOperationTupel("WRITE", writesRelStr, target.schemaprefix)
 	if err != nil {
 		return renderErr(err), nil
 	}
 	updateRelationships = append(updateRelationships, updates...)
 
-	updates, err = generateAuthzedOperationTupel("TOUCH", touchesRelStr)
+	updates, err = generateAuthzedOperationTupel("TOUCH", touchesRelStr, target.schemaprefix)
 	if err != nil {
 		return renderErr(err), nil
 	}
 	updateRelationships = append(updateRelationships, updates...)
 
-	updates, err = generateAuthzedOperationTupel("DELETE", deletesRelStr)
+	updates, err = generateAuthzedOperationTupel("DELETE", deletesRelStr, target.schemaprefix)
 	if err != nil {
 		return renderErr(err), nil
 
@@ -219,32 +334,32 @@ func WriteRelationshipsBuiltinImpl(bctx rego.BuiltinContext, writesTerm, touches
 	updateRelationships = append(updateRelationships, updates...)
 
 	writeRequest := &authzedpb.WriteRelationshipsRequest{
-		Updates: updateRelationships,
+		Updates:               updateRelationships,
+		OptionalPreconditions: newPreconditions(opts.preconditions, target.schemaprefix),
 	}
-	fmt.Println(writeRequest)
 
-	// get client
-	client := authzed.GetAuthzedClient()
-	if client == nil {
-		return nil, errors.New("authzed client not configured")
-	}
+	client := target.connection.Client()
+	ctx, cancel := target.connection.Context(bctx.Context, authzed.RequestWrite)
+	defer cancel()
 
 	// do query
-	response, err := client.WriteRelationships(bctx.Context, writeRequest)
+	response, err := client.WriteRelationships(ctx, writeRequest)
 
 	if err != nil { // error condition seems NOT to catch issues with the write request
-		// extract if gRPC error
-		if s, ok := status.FromError(err); ok {
-			// Extract code & description
-			error_result = ErrorStruct{s.Code().String(), s.Message()}
-		} else {
-			var errorstring = fmt.Sprintf("%s", err)
-			error_result = ErrorStruct{"Error", errorstring}
-		}
+		error_result = newErrorStruct(err)
 
 		var error_term, _ = ast.InterfaceToValue(error_result)
 		return ast.NewTerm(error_term), nil
 	}
+	// the written relationships invalidate cached results
+	var resourceTypes []string
+	for _, relationships := range [][]relationshipStruct{writesRelStr, touchesRelStr, deletesRelStr} {
+		for _, relationship := range relationships {
+			resourceTypes = append(resourceTypes, relationship.ResourceType)
+		}
+	}
+	cacheEvict(bctx, target, resourceTypes...)
+
 	// extract ZedToken
 	var token string = response.WrittenAt.Token
 	zedtoken := ZedToken(token)
@@ -0,0 +1,212 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// CircuitBreakerConfig configures failing fast after consecutive failed requests.
+type CircuitBreakerConfig struct {
+	FailureThreshold int    `json:"failure_threshold"` // consecutive failures opening the breaker
+	Cooldown         string `json:"cooldown"`          // time until a trial request is let through, defaults to 30s
+
+	cooldown time.Duration
+}
+
+// validate checks the threshold and parses the cooldown.
+func (c *CircuitBreakerConfig) validate() error {
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("invalid circuit_breaker failure_threshold: %d", c.FailureThreshold)
+	}
+
+	c.cooldown = defaultBreakerCooldown
+	if c.Cooldown != "" {
+		cooldown, err := time.ParseDuration(c.Cooldown)
+		if err != nil || cooldown <= 0 {
+			return fmt.Errorf("invalid circuit_breaker cooldown: '%s'", c.Cooldown)
+		}
+		c.cooldown = cooldown
+	}
+
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker fails requests fast while spicedb is unavailable: it opens after the configured number of
+// consecutive failures and lets a single trial request through once the cooldown passed (half-open).
+// A successful trial closes the breaker, a failed one opens it again.
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+
+	mtx      sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	lastErr  error
+	trial    bool // the trial request of the half-open breaker is in flight
+	listener func(message string, err error)
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{config: config}
+}
+
+// setListener registers the function reporting state changes, and reports the current state.
+func (b *circuitBreaker) setListener(listener func(message string, err error)) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.listener = listener
+	b.notify()
+}
+
+// notify reports the state to the listener, the lock must be held.
+func (b *circuitBreaker) notify() {
+	if b.listener == nil {
+		return
+	}
+	switch b.state {
+	case breakerOpen:
+		b.listener("", fmt.Errorf("circuit breaker open after %d consecutive failures, half-open at %s: %w",
+			b.failures, b.openedAt.Add(b.config.cooldown).Format(time.RFC3339), b.lastErr))
+	case breakerHalfOpen:
+		b.listener("", fmt.Errorf("circuit breaker half-open, waiting for the trial request, last error: %w", b.lastErr))
+	default:
+		b.listener("circuit breaker closed", nil)
+	}
+}
+
+// allow returns an UNAVAILABLE error if a request must fail fast.
+func (b *circuitBreaker) allow() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.config.cooldown {
+			return status.Errorf(codes.Unavailable, "circuit breaker open: %v", b.lastErr)
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		b.notify()
+	case breakerHalfOpen:
+		if b.trial {
+			return status.Errorf(codes.Unavailable, "circuit breaker half-open: %v", b.lastErr)
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// done records the outcome of a request let through.
+func (b *circuitBreaker) done(err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		b.failures++
+		b.lastErr = err
+		b.trial = false
+		if b.state == breakerHalfOpen || b.failures >= b.config.FailureThreshold {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+			b.notify()
+		}
+	case codes.Canceled:
+		// the caller gave up, nothing learned about spicedb
+		b.trial = false
+	default:
+		b.failures = 0
+		b.trial = false
+		if b.state != breakerClosed {
+			b.state = breakerClosed
+			b.notify()
+		}
+	}
+}
+
+// bypassBreaker is the call option of the health probes: they report whether spicedb is reachable even
+// while the breaker is open, and their failures don't count towards opening it.
+type bypassBreaker struct {
+	grpc.EmptyCallOption
+}
+
+// skipped reports whether a call bypasses the breaker: the long-lived watch stream has its own backoff,
+// the health probes have their own interval.
+func (b *circuitBreaker) skipped(method string, opts []grpc.CallOption) bool {
+	if strings.HasPrefix(method, "/authzed.api.v1.WatchService/") {
+		return true
+	}
+	for _, opt := range opts {
+		if _, bypass := opt.(bypassBreaker); bypass {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *circuitBreaker) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if b.skipped(method, opts) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	b.done(err)
+	return err
+}
+
+func (b *circuitBreaker) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if b.skipped(method, opts) {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		b.done(err)
+		return nil, err
+	}
+	return &breakerStream{ClientStream: stream, breaker: b}, nil
+}
+
+// breakerStream records the outcome of a stream with its first response: spicedb answering is a success.
+type breakerStream struct {
+	grpc.ClientStream
+	breaker *circuitBreaker
+	once    sync.Once
+}
+
+func (s *breakerStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.once.Do(func() {
+		if errors.Is(err, io.EOF) {
+			s.breaker.done(nil)
+		} else {
+			s.breaker.done(err)
+		}
+	})
+	return err
+}
@@ -0,0 +1,51 @@
+package spicedb
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBreakerBypassedByProbes(t *testing.T) {
+	config := CircuitBreakerConfig{FailureThreshold: 2}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	breaker := newCircuitBreaker(config)
+
+	invoked := 0
+	unavailable := func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+		invoked++
+		return status.Error(codes.Unavailable, "connection refused")
+	}
+	call := func(opts ...grpc.CallOption) error {
+		return breaker.unaryInterceptor(context.Background(), "/authzed.api.v1.SchemaService/ReadSchema", nil, nil, nil, unavailable, opts...)
+	}
+
+	// failing probes don't open the breaker
+	for range 3 {
+		call(bypassBreaker{})
+	}
+	if breaker.state != breakerClosed {
+		t.Fatal("expected probe failures not to open the breaker")
+	}
+
+	call()
+	call()
+	if breaker.state != breakerOpen {
+		t.Fatal("expected request failures to open the breaker")
+	}
+
+	// the open breaker fails requests fast, probes still reach spicedb
+	invoked = 0
+	if err := call(); status.Code(err) != codes.Unavailable || invoked != 0 {
+		t.Fatalf("expected the request to fail fast, got %v after %d calls", err, invoked)
+	}
+	call(bypassBreaker{})
+	if invoked != 1 {
+		t.Fatal("expected the probe to bypass the open breaker")
+	}
+}
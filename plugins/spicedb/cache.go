@@ -0,0 +1,277 @@
+package spicedb
+
+import (
+	"container/list"
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"sync"
+	"time"
+)
+
+// ScopeAll marks cached results depending on any relationship, e.g. permission checks and lookups.
+const ScopeAll = ""
+
+// ScopeSchema marks cached results depending on the schema only.
+const ScopeSchema = "#schema"
+
+// watchedTTL bounds the time results without configured TTL are kept while the watch stream is connected:
+// relationships reaching their expiration produce no watch event.
+const watchedTTL = time.Minute
+
+// defaultCacheMaxEntries bounds the result cache when neither max_entries nor max_bytes are configured.
+const defaultCacheMaxEntries = 10000
+
+// cachedBuiltins lists the builtins a TTL can be configured for, "default" applies to all builtins without own TTL.
+// spicedb.check_bulk_permissions shares its results with spicedb.check_permission.
+var cachedBuiltins = map[string]bool{
+	"default":                true,
+	"check_permission":       true,
+	"lookup_resources":       true,
+	"lookup_subjects":        true,
+	"read_relationships":     true,
+	"expand_permission_tree": true,
+	"read_schema":            true,
+	"reflect_schema":         true,
+}
+
+// CacheConfig bounds the results cached across queries.
+type CacheConfig struct {
+	MaxEntries  int               `json:"max_entries"` // defaults to 10000 without max_bytes
+	MaxBytes    int64             `json:"max_bytes"`
+	TTL         map[string]string `json:"ttl"`          // per builtin, eg. {"default": "10s", "check_permission": "1s"}
+	NegativeTTL string            `json:"negative_ttl"` // for denied checks and empty results, defaults to the builtin TTL
+
+	ttl         map[string]time.Duration
+	negativeTTL time.Duration
+}
+
+// validate parses the configured durations.
+func (c *CacheConfig) validate() error {
+	if c.MaxEntries < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("invalid cache bounds: max_entries %d, max_bytes %d", c.MaxEntries, c.MaxBytes)
+	}
+
+	c.ttl = make(map[string]time.Duration)
+	for builtin, value := range c.TTL {
+		if !cachedBuiltins[builtin] {
+			return fmt.Errorf("unknown builtin in cache ttl: '%s'", builtin)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid cache ttl for %s: '%s'", builtin, value)
+		}
+		c.ttl[builtin] = ttl
+	}
+
+	if c.NegativeTTL != "" {
+		ttl, err := time.ParseDuration(c.NegativeTTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid cache negative_ttl: '%s'", c.NegativeTTL)
+		}
+		c.negativeTTL = ttl
+	}
+
+	return nil
+}
+
+// resultCache holds builtin results across queries, least recently used entries are dropped first when
+// exceeding the size bounds. Entries are scoped by the (prefixed) resource type of the relationships they
+// were computed from and evicted when those are changed, by the watcher or by the mutating builtins.
+// Without a connected watch stream, only entries with a TTL are cached, with it entries without TTL are kept
+// for watchedTTL at most.
+type resultCache struct {
+	mtx        sync.Mutex
+	config     CacheConfig
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int64
+	generation uint64
+	watched    bool // changes are observed by the watch stream, entries without TTL are kept for watchedTTL
+}
+
+type cacheEntry struct {
+	key     string
+	value   any
+	scope   string
+	size    int64
+	expires time.Time
+}
+
+func newResultCache(config CacheConfig) *resultCache {
+	if config.MaxEntries == 0 && config.MaxBytes == 0 {
+		config.MaxEntries = defaultCacheMaxEntries
+	}
+	return &resultCache{
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// ttl returns how long a result of the builtin is cached, zero if no TTL is configured.
+func (c *resultCache) ttl(builtin string, negative bool) time.Duration {
+	if negative && c.config.negativeTTL > 0 {
+		return c.config.negativeTTL
+	}
+	if ttl, found := c.config.ttl[builtin]; found {
+		return ttl
+	}
+	return c.config.ttl["default"]
+}
+
+// get returns a cached value and the current generation, to be passed to put.
+func (c *resultCache) get(key string) (any, uint64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, c.generation, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, c.generation, false
+	}
+
+	c.lru.MoveToFront(element)
+	return entry.value, c.generation, true
+}
+
+// put stores a value, unless entries were evicted since the generation was obtained: the value
+// might have been computed before the change and is stale already.
+func (c *resultCache) put(key string, builtin string, value any, scope string, size int64, negative bool, generation uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	ttl := c.ttl(builtin, negative)
+	if ttl == 0 {
+		if !c.watched {
+			// nothing would invalidate the entry
+			return
+		}
+		ttl = watchedTTL
+	}
+	if c.config.MaxBytes > 0 && size > c.config.MaxBytes {
+		return
+	}
+
+	entry := &cacheEntry{key: key, value: value, scope: scope, size: size, expires: time.Now().Add(ttl)}
+
+	if element, found := c.entries[key]; found {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += size
+
+	for (c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries) || (c.config.MaxBytes > 0 && c.bytes > c.config.MaxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry, the lock must be held.
+func (c *resultCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// evict removes the entries depending on relationships of the given resource types.
+func (c *resultCache) evict(resourceTypes map[string]bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.generation++
+	for _, element := range c.entries {
+		if entry := element.Value.(*cacheEntry); entry.scope == ScopeAll || resourceTypes[entry.scope] {
+			c.remove(element)
+		}
+	}
+}
+
+// reset removes all entries and sets whether changes are observed by the watch stream.
+func (c *resultCache) reset(watched bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.generation++
+	c.watched = watched
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+func (c *Connection) resultCache() *resultCache {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.cache
+}
+
+// isWatched reports whether changes are observed by the watch stream.
+func (c *resultCache) isWatched() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.watched
+}
+
+// ReadConsistency returns the consistency to read a result cached across queries with. While the watch stream
+// is connected, minimize_latency reads are made at least as fresh as the last revision seen on the stream:
+// spicedb might otherwise answer from a revision before a change the stream already evicted, and the result
+// would be cached as if it was current.
+func (c *Connection) ReadConsistency(consistency *authzedpb.Consistency) *authzedpb.Consistency {
+	if consistency != nil && !consistency.GetMinimizeLatency() {
+		return consistency
+	}
+
+	cache := c.resultCache()
+	revision := c.Revision()
+	if cache == nil || revision == "" || !cache.isWatched() {
+		return consistency
+	}
+	return &authzedpb.Consistency{
+		Requirement: &authzedpb.Consistency_AtLeastAsFresh{AtLeastAsFresh: &authzedpb.ZedToken{Token: revision}},
+	}
+}
+
+// CacheGet returns a result cached across queries, together with the cache generation.
+// Nothing is found if the cross-query cache is disabled.
+func (c *Connection) CacheGet(key string) (any, uint64, bool) {
+	cache := c.resultCache()
+	if cache == nil {
+		return nil, 0, false
+	}
+	return cache.get(key)
+}
+
+// CachePut stores a result of the builtin across queries, size is its approximate size in bytes. Negative
+// results (denied checks, empty lookups) may use a separate TTL. The generation must be obtained by
+// CacheGet before the result was fetched from spicedb.
+func (c *Connection) CachePut(key string, builtin string, value any, scope string, size int64, negative bool, generation uint64) {
+	cache := c.resultCache()
+	if cache == nil {
+		return
+	}
+	cache.put(key, builtin, value, scope, size, negative, generation)
+}
+
+// CacheEvict removes the results depending on relationships of the given (prefixed) resource types,
+// to be called after relationships were written or deleted.
+func (c *Connection) CacheEvict(objectTypes ...string) {
+	cache := c.resultCache()
+	if cache == nil {
+		return
+	}
+
+	changed := make(map[string]bool, len(objectTypes))
+	for _, objectType := range objectTypes {
+		changed[objectType] = true
+	}
+	cache.evict(changed)
+}
@@ -0,0 +1,63 @@
+package spicedb
+
+import (
+	"testing"
+	"time"
+
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+func TestWatchedEntriesExpire(t *testing.T) {
+	cache := newResultCache(CacheConfig{})
+	cache.reset(true)
+
+	_, generation, _ := cache.get("key")
+	cache.put("key", "check_permission", "allowed", ScopeAll, 1, false, generation)
+
+	element, found := cache.entries["key"]
+	if !found {
+		t.Fatal("expected the result to be cached while watched")
+	}
+	if expires := element.Value.(*cacheEntry).expires; expires.IsZero() || time.Until(expires) > watchedTTL {
+		t.Fatalf("expected the entry to expire within %v, expires at %v", watchedTTL, expires)
+	}
+}
+
+func TestReadConsistencyFollowsWatch(t *testing.T) {
+	connection := &Connection{cache: newResultCache(CacheConfig{})}
+	minimizeLatency := &authzedpb.Consistency{Requirement: &authzedpb.Consistency_MinimizeLatency{MinimizeLatency: true}}
+	fullyConsistent := &authzedpb.Consistency{Requirement: &authzedpb.Consistency_FullyConsistent{FullyConsistent: true}}
+
+	// not watched yet
+	connection.setRevision("revision")
+	if consistency := connection.ReadConsistency(minimizeLatency); consistency != minimizeLatency {
+		t.Fatalf("expected the requested consistency without watch stream, got %v", consistency)
+	}
+
+	connection.cache.reset(true)
+	for _, requested := range []*authzedpb.Consistency{nil, minimizeLatency} {
+		if token := connection.ReadConsistency(requested).GetAtLeastAsFresh().GetToken(); token != "revision" {
+			t.Fatalf("expected reads at least as fresh as the watched revision, got %q", token)
+		}
+	}
+	if consistency := connection.ReadConsistency(fullyConsistent); consistency != fullyConsistent {
+		t.Fatalf("expected an explicit consistency to be kept, got %v", consistency)
+	}
+}
+
+func TestCacheDefaultBounds(t *testing.T) {
+	tests := []struct {
+		config     CacheConfig
+		maxEntries int
+	}{
+		{CacheConfig{}, defaultCacheMaxEntries},
+		{CacheConfig{MaxEntries: 10}, 10},
+		{CacheConfig{MaxBytes: 1024}, 0},
+	}
+
+	for _, test := range tests {
+		if maxEntries := newResultCache(test.config).config.MaxEntries; maxEntries != test.maxEntries {
+			t.Errorf("%+v: expected max_entries %d, got %d", test.config, test.maxEntries, maxEntries)
+		}
+	}
+}
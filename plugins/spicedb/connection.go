@@ -0,0 +1,301 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/authzed/grpcutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DefaultConnection is the name of the connection used by builtins called without connection name.
+const DefaultConnection = "default"
+
+// RequestKind groups the requests of the builtins sharing a timeout.
+type RequestKind string
+
+const (
+	RequestCheck  RequestKind = "check"  // check_permission, check_bulk_permissions
+	RequestLookup RequestKind = "lookup" // lookup_resources, lookup_subjects, expand_permission_tree
+	RequestRead   RequestKind = "read"   // read_relationships, read_schema, reflect_schema
+	RequestWrite  RequestKind = "write"  // write_relationships
+	RequestDelete RequestKind = "delete" // delete_relationships
+)
+
+// TimeoutsConfig configures the timeouts per request kind, overriding the timeout of the connection.
+type TimeoutsConfig struct {
+	Check  string `json:"check"`
+	Lookup string `json:"lookup"`
+	Read   string `json:"read"`
+	Write  string `json:"write"`
+	Delete string `json:"delete"`
+}
+
+// ConnectionConfig configures a spicedb endpoint.
+type ConnectionConfig struct {
+	Endpoint     string `json:"endpoint"`
+	Insecure     bool   `json:"insecure"`
+	Token        string `json:"token"`
+	Schemaprefix string `json:"schemaprefix"`
+
+	// replicas balanced by one client instead of a single endpoint, and the endpoint groups failed over to
+	// in order while the primary endpoints are unavailable
+	Endpoints     []string   `json:"endpoints"`
+	LoadBalancing string     `json:"load_balancing"` // pick_first (default) or round_robin
+	Failover      [][]string `json:"failover"`       // eg. [["standby-a:50051", "standby-b:50051"]]
+
+	// read-only replicas receiving the reads, while writes go to the primary write_endpoint
+	WriteEndpoint string   `json:"write_endpoint"` // instead of endpoint
+	ReadEndpoint  string   `json:"read_endpoint"`
+	ReadEndpoints []string `json:"read_endpoints"` // balanced like endpoints
+
+	// credential providers replacing the literal token
+	TokenFile    string   `json:"token_file"`    // watched for changes
+	TokenEnv     string   `json:"token_env"`     // name of an environment variable
+	TokenExec    []string `json:"token_exec"`    // command printing the token, eg. ["vault", "read", "-field=token", "secret/spicedb"]
+	TokenRefresh string   `json:"token_refresh"` // interval to fetch the token again, defaults to 1m
+
+	Timeout  string          `json:"timeout"`  // deadline of the requests, eg. 5s
+	Timeouts *TimeoutsConfig `json:"timeouts"` // deadline per request kind, eg. {"check": "500ms", "lookup": "5s"}
+
+	// custom CA and client certificate, as file paths or PEM; files are reloaded when they change
+	CACert     string `json:"ca_cert"`
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	ServerName string `json:"server_name"` // overrides the server name verified in the server certificate
+
+	// schema prefixes builtins may select per call, besides the configured schemaprefix
+	AllowedPrefixes []string `json:"allowed_prefixes"`
+	PrefixPattern   string   `json:"prefix_pattern"` // regular expression matching the whole prefix, eg. "tenant_[a-z0-9]+/"
+
+	Retry          *RetryConfig          `json:"retry"`           // retries of idempotent requests
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"` // fail fast after consecutive failures
+
+	timeout       time.Duration
+	timeouts      map[RequestKind]time.Duration
+	tokenRefresh  time.Duration
+	prefixPattern *regexp.Regexp
+}
+
+// validate checks the endpoints and parses the configured durations, the retry and circuit breaker settings
+// and the prefix pattern.
+func (c *ConnectionConfig) validate() error {
+	if c.Insecure && c.tlsConfigured() {
+		return errors.New("insecure can't be combined with ca_cert, client_cert, client_key or server_name")
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return errors.New("client_cert and client_key must be configured together")
+	}
+	if err := c.validateEndpoints(); err != nil {
+		return err
+	}
+	if err := c.validateCredentials(); err != nil {
+		return err
+	}
+
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout: '%s'", c.Timeout)
+		}
+		c.timeout = timeout
+	}
+
+	c.timeouts = make(map[RequestKind]time.Duration)
+	if c.Timeouts != nil {
+		for kind, value := range map[RequestKind]string{
+			RequestCheck:  c.Timeouts.Check,
+			RequestLookup: c.Timeouts.Lookup,
+			RequestRead:   c.Timeouts.Read,
+			RequestWrite:  c.Timeouts.Write,
+			RequestDelete: c.Timeouts.Delete,
+		} {
+			if value == "" {
+				continue
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid %s timeout: '%s'", kind, value)
+			}
+			c.timeouts[kind] = timeout
+		}
+	}
+
+	if c.Retry != nil {
+		if err := c.Retry.validate(); err != nil {
+			return err
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.PrefixPattern != "" {
+		pattern, err := regexp.Compile("^(?:" + c.PrefixPattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid prefix_pattern: %w", err)
+		}
+		c.prefixPattern = pattern
+	}
+
+	return nil
+}
+
+// Connection is a named spicedb client together with its schema prefix and the results cached across queries.
+// Requests are sent to the active endpoint group, see Client.
+type Connection struct {
+	Name         string
+	Schemaprefix string
+	Timeout      time.Duration
+
+	timeouts        map[RequestKind]time.Duration
+	allowedPrefixes map[string]bool
+	prefixPattern   *regexp.Regexp
+
+	groups        []*endpointGroup // the primary endpoints followed by the failover groups
+	replicas      *endpointGroup   // the read endpoints, nil unless configured
+	onUnavailable map[string]string
+	stale         *staleCache // nil unless a builtin serves stale results
+
+	mtx           sync.Mutex
+	active        int           // index of the endpoint group requests are sent to
+	activeChanged chan struct{} // closed when the active endpoint group changes
+	replicasDown  bool          // reads are sent to the active endpoint group while the replicas are unavailable
+	cache         *resultCache
+	revision      string // the last revision seen on the watch stream, empty until connected
+}
+
+// newClient creates the client of an endpoint group together with its circuit breaker.
+func newClient(name string, config ConnectionConfig, endpoints []string) (*authzed.Client, *circuitBreaker, error) {
+	var grpcSecurity grpc.DialOption
+	var err error
+	switch {
+	case config.Insecure:
+		grpcSecurity = grpc.WithTransportCredentials(insecure.NewCredentials())
+	case config.tlsConfigured():
+		grpcSecurity, err = withTLS(config)
+	default:
+		grpcSecurity, err = grpcutil.WithSystemCerts(grpcutil.VerifyCA)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("connection %s: %w", name, err)
+	}
+
+	target, options := withEndpoints(name, endpoints, config.ServerName)
+	options = append(options, grpcSecurity, grpc.WithPerRPCCredentials(newTokenCredentials(config)))
+
+	serviceConfig, err := withServiceConfig(config, len(endpoints) > 1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connection %s: %w", name, err)
+	}
+	if serviceConfig != nil {
+		options = append(options, serviceConfig)
+	}
+
+	var breaker *circuitBreaker
+	if config.CircuitBreaker != nil {
+		breaker = newCircuitBreaker(*config.CircuitBreaker)
+		options = append(options,
+			grpc.WithChainUnaryInterceptor(breaker.unaryInterceptor),
+			grpc.WithChainStreamInterceptor(breaker.streamInterceptor),
+		)
+	}
+
+	client, err := authzed.NewClient(target, options...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connection %s: %w", name, err)
+	}
+
+	return client, breaker, nil
+}
+
+// newConnection creates a connection using the endpoint groups and read replicas created for its configuration.
+func newConnection(name string, config ConnectionConfig, groups []*endpointGroup, replicas *endpointGroup) *Connection {
+	allowedPrefixes := make(map[string]bool, len(config.AllowedPrefixes))
+	for _, prefix := range config.AllowedPrefixes {
+		allowedPrefixes[prefix] = true
+	}
+
+	return &Connection{
+		Name:            name,
+		groups:          groups,
+		replicas:        replicas,
+		activeChanged:   make(chan struct{}),
+		Schemaprefix:    config.Schemaprefix,
+		Timeout:         config.timeout,
+		timeouts:        config.timeouts,
+		allowedPrefixes: allowedPrefixes,
+		prefixPattern:   config.prefixPattern,
+	}
+}
+
+// SelectSchemaprefix returns the schema prefix to apply to a builtin call: the configured schemaprefix,
+// unless the call selects one of the allowed prefixes or a prefix matching the prefix pattern.
+func (c *Connection) SelectSchemaprefix(prefix *string) (string, error) {
+	if prefix == nil || *prefix == c.Schemaprefix {
+		return c.Schemaprefix, nil
+	}
+	if c.allowedPrefixes[*prefix] || (c.prefixPattern != nil && c.prefixPattern.MatchString(*prefix)) {
+		return *prefix, nil
+	}
+	return "", fmt.Errorf("schema prefix not allowed on connection %s: '%s'", c.Name, *prefix)
+}
+
+// Context derives the context of a request, bounded by the timeout of its kind or else the timeout of the
+// connection. The deadline of the evaluation still applies if it is earlier.
+func (c *Connection) Context(ctx context.Context, kind RequestKind) (context.Context, context.CancelFunc) {
+	timeout, found := c.timeouts[kind]
+	if !found {
+		timeout = c.Timeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c *Connection) setRevision(revision string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.revision = revision
+}
+
+// Revision returns the latest revision seen on the watch stream of the connection.
+func (c *Connection) Revision() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.revision
+}
+
+// GetConnection returns the named connection, the default connection if the name is empty.
+func GetConnection(name string) (*Connection, error) {
+	if instance == nil {
+		return nil, errors.New("authzed client not configured")
+	}
+
+	if name == "" {
+		name = DefaultConnection
+	}
+
+	instance.mtx.Lock()
+	defer instance.mtx.Unlock()
+
+	if instance.connections == nil {
+		return nil, errors.New("authzed client not configured")
+	}
+
+	connection, found := instance.connections[name]
+	if !found {
+		return nil, fmt.Errorf("unknown spicedb connection: '%s'", name)
+	}
+	return connection, nil
+}
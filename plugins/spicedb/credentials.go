@@ -0,0 +1,206 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenRefresh = time.Minute
+	tokenRetryInterval  = 5 * time.Second // fetching again after a failure, unless the refresh is shorter
+	tokenExecTimeout    = 30 * time.Second
+)
+
+// tokenCredentials provides the preshared key of a connection as gRPC PerRPCCredentials. The token is
+// fetched again after the refresh interval, or when the token file changed, so rotated secrets take
+// effect without reconfiguring the plugin. Fetching runs in the background while requests use the
+// previous token, only the first fetch is waited for.
+type tokenCredentials struct {
+	fetch   func(ctx context.Context) (string, error)
+	refresh time.Duration // zero if the token never changes
+	file    string        // token file watched for changes
+
+	mtx       sync.Mutex
+	token     string
+	err       error     // error of the last fetch
+	attempted time.Time // time of the last fetch
+	modTime   time.Time
+	fetching  chan struct{} // closed when the running fetch completed, nil if none is running
+}
+
+// newTokenCredentials selects the credential provider of a connection: a literal token, a token file,
+// an environment variable or a command printing the token.
+func newTokenCredentials(config ConnectionConfig) *tokenCredentials {
+	refresh := config.tokenRefresh
+	if refresh == 0 {
+		refresh = defaultTokenRefresh
+	}
+
+	switch {
+	case config.TokenFile != "":
+		return &tokenCredentials{
+			file:    config.TokenFile,
+			refresh: refresh,
+			fetch: func(context.Context) (string, error) {
+				token, err := os.ReadFile(config.TokenFile)
+				return string(token), err
+			},
+		}
+	case config.TokenEnv != "":
+		return &tokenCredentials{
+			refresh: refresh,
+			fetch: func(context.Context) (string, error) {
+				token, found := os.LookupEnv(config.TokenEnv)
+				if !found {
+					return "", fmt.Errorf("environment variable %s not set", config.TokenEnv)
+				}
+				return token, nil
+			},
+		}
+	case len(config.TokenExec) > 0:
+		return &tokenCredentials{
+			refresh: refresh,
+			fetch: func(ctx context.Context) (string, error) {
+				ctx, cancel := context.WithTimeout(ctx, tokenExecTimeout)
+				defer cancel()
+
+				token, err := exec.CommandContext(ctx, config.TokenExec[0], config.TokenExec[1:]...).Output()
+				if err != nil {
+					return "", fmt.Errorf("token_exec: %w", err)
+				}
+				return string(token), nil
+			},
+		}
+	default:
+		return &tokenCredentials{
+			fetch: func(context.Context) (string, error) {
+				return config.Token, nil
+			},
+		}
+	}
+}
+
+// current returns the token, fetching it again in the background if it might have changed. If fetching
+// fails, the previous token is used and fetching is retried after tokenRetryInterval.
+func (c *tokenCredentials) current(ctx context.Context) (string, error) {
+	c.mtx.Lock()
+	if c.stale() {
+		c.startFetch()
+	}
+	token, err, fetching := c.token, c.err, c.fetching
+	c.mtx.Unlock()
+
+	if token != "" {
+		return token, nil
+	}
+	if fetching == nil {
+		return "", err
+	}
+
+	// no token yet, wait for the first fetch
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+	return "", c.err
+}
+
+// stale reports whether the token should be fetched again, the lock must be held.
+func (c *tokenCredentials) stale() bool {
+	if c.fetching != nil {
+		return false
+	}
+
+	stale := c.attempted.IsZero()
+	if c.file != "" {
+		if info, err := os.Stat(c.file); err == nil && !info.ModTime().Equal(c.modTime) {
+			c.modTime = info.ModTime()
+			stale = true
+		}
+	}
+	if stale {
+		return true
+	}
+
+	interval := c.refresh
+	if c.err != nil && (interval == 0 || interval > tokenRetryInterval) {
+		interval = tokenRetryInterval
+	}
+	return interval > 0 && time.Since(c.attempted) >= interval
+}
+
+// startFetch fetches the token in the background, the lock must be held.
+func (c *tokenCredentials) startFetch() {
+	fetching := make(chan struct{})
+	c.fetching = fetching
+
+	go func() {
+		defer close(fetching)
+
+		token, err := c.fetch(context.Background())
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		c.attempted = time.Now()
+		c.fetching = nil
+		c.err = err
+		if err == nil {
+			c.token = strings.TrimSpace(token)
+		}
+	}()
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	token, err := c.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, nil
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials, tokens are sent on insecure connections as well.
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// validateCredentials checks that at most one credential provider is configured.
+func (c *ConnectionConfig) validateCredentials() error {
+	configured := 0
+	for _, set := range []bool{c.Token != "", c.TokenFile != "", c.TokenEnv != "", len(c.TokenExec) > 0} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return errors.New("only one of token, token_file, token_env and token_exec can be configured")
+	}
+
+	if c.TokenRefresh != "" {
+		refresh, err := time.ParseDuration(c.TokenRefresh)
+		if err != nil || refresh <= 0 {
+			return fmt.Errorf("invalid token_refresh: '%s'", c.TokenRefresh)
+		}
+		c.tokenRefresh = refresh
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenRefreshInBackground(t *testing.T) {
+	var calls atomic.Int64
+	release := make(chan struct{})
+
+	credentials := &tokenCredentials{
+		refresh: time.Millisecond,
+		fetch: func(context.Context) (string, error) {
+			if calls.Add(1) == 1 {
+				return "first\n", nil
+			}
+			<-release
+			return "second", nil
+		},
+	}
+
+	token, err := credentials.current(context.Background())
+	if err != nil || token != "first" {
+		t.Fatalf("expected the first token, got %q %v", token, err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	// the refresh blocks, requests keep using the previous token without waiting or fetching again
+	for range 3 {
+		token, err = credentials.current(context.Background())
+		if err != nil || token != "first" {
+			t.Fatalf("expected the previous token while refreshing, got %q %v", token, err)
+		}
+	}
+	waitFor(t, func() bool { return calls.Load() == 2 })
+	credentials.current(context.Background())
+	if calls.Load() != 2 {
+		t.Fatalf("expected a single refresh, got %d fetches", calls.Load())
+	}
+
+	close(release)
+	waitFor(t, func() bool {
+		token, _ := credentials.current(context.Background())
+		return token == "second"
+	})
+}
+
+func TestTokenFetchFailureBacksOff(t *testing.T) {
+	var calls atomic.Int64
+
+	credentials := &tokenCredentials{
+		refresh: time.Hour,
+		fetch: func(context.Context) (string, error) {
+			calls.Add(1)
+			return "", errors.New("unavailable")
+		},
+	}
+
+	for range 5 {
+		if _, err := credentials.current(context.Background()); err == nil {
+			t.Fatal("expected the fetch error without a previous token")
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected failed fetches to be retried after %v, got %d fetches", tokenRetryInterval, calls.Load())
+	}
+}
+
+// waitFor polls the condition for up to a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("condition not met")
+}
@@ -0,0 +1,283 @@
+package spicedb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/authzed/authzed-go/v1"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/health" // client side health checking of round_robin endpoints
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"net"
+	"strings"
+)
+
+// load balancing policies of an endpoint group
+const (
+	PickFirst  = "pick_first"  // the first reachable endpoint receives all requests
+	RoundRobin = "round_robin" // requests are spread over all healthy endpoints
+)
+
+// healthCheckService is the gRPC health service checked on every endpoint of a round_robin group,
+// the balancer skips endpoints not serving it.
+const healthCheckService = "authzed.api.v1.PermissionsService"
+
+// endpointGroup is a set of endpoints balanced by one client: the primary endpoints of a connection or
+// one of its failover groups.
+type endpointGroup struct {
+	endpoints []string
+	client    *authzed.Client
+	breaker   *circuitBreaker // nil unless configured
+}
+
+func (g *endpointGroup) String() string {
+	if len(g.endpoints) == 1 {
+		return g.endpoints[0]
+	}
+	return "[" + strings.Join(g.endpoints, ",") + "]"
+}
+
+// endpointGroups returns the primary endpoints followed by the failover groups, in failover order.
+func (c *ConnectionConfig) endpointGroups() [][]string {
+	primary := c.Endpoints
+	if len(primary) == 0 {
+		endpoint := c.Endpoint
+		if c.WriteEndpoint != "" {
+			endpoint = c.WriteEndpoint
+		}
+		primary = []string{endpoint}
+	}
+	return append([][]string{primary}, c.Failover...)
+}
+
+// readEndpoints returns the read replicas, nil if reads are sent to the primary endpoints.
+func (c *ConnectionConfig) readEndpoints() []string {
+	if len(c.ReadEndpoints) > 0 {
+		return c.ReadEndpoints
+	}
+	if c.ReadEndpoint != "" {
+		return []string{c.ReadEndpoint}
+	}
+	return nil
+}
+
+// hasEndpoint reports whether the primary endpoints are configured.
+func (c *ConnectionConfig) hasEndpoint() bool {
+	return c.Endpoint != "" || len(c.Endpoints) > 0 || c.WriteEndpoint != ""
+}
+
+// validateEndpoints checks the endpoint lists and the load balancing policy.
+func (c *ConnectionConfig) validateEndpoints() error {
+	if !c.hasEndpoint() {
+		return errors.New("endpoint, endpoints or write_endpoint is required")
+	}
+	if c.Endpoint != "" && len(c.Endpoints) > 0 {
+		return errors.New("endpoint and endpoints can't be combined")
+	}
+	if c.WriteEndpoint != "" && (c.Endpoint != "" || len(c.Endpoints) > 0) {
+		return errors.New("write_endpoint can't be combined with endpoint or endpoints")
+	}
+	if c.ReadEndpoint != "" && len(c.ReadEndpoints) > 0 {
+		return errors.New("read_endpoint and read_endpoints can't be combined")
+	}
+
+	switch c.LoadBalancing {
+	case "", PickFirst, RoundRobin:
+	default:
+		return fmt.Errorf("invalid load_balancing: '%s', must be %s or %s", c.LoadBalancing, PickFirst, RoundRobin)
+	}
+
+	for i, group := range c.Failover {
+		if len(group) == 0 {
+			return fmt.Errorf("failover group %d has no endpoints", i+1)
+		}
+	}
+	for _, group := range c.endpointGroups()[1:] {
+		for _, endpoint := range group {
+			if endpoint == "" {
+				return errors.New("empty endpoint in failover")
+			}
+		}
+	}
+	for _, endpoint := range c.Endpoints {
+		if endpoint == "" {
+			return errors.New("empty endpoint in endpoints")
+		}
+	}
+	for _, endpoint := range c.ReadEndpoints {
+		if endpoint == "" {
+			return errors.New("empty endpoint in read_endpoints")
+		}
+	}
+
+	return nil
+}
+
+// newEndpointGroups creates a client for each endpoint group of a connection and for its read replicas,
+// the endpoints are dialed lazily.
+func newEndpointGroups(name string, config ConnectionConfig) ([]*endpointGroup, *endpointGroup, error) {
+	groups := []*endpointGroup{}
+	for _, endpoints := range config.endpointGroups() {
+		client, breaker, err := newClient(name, config, endpoints)
+		if err != nil {
+			closeEndpointGroups(groups)
+			return nil, nil, err
+		}
+		groups = append(groups, &endpointGroup{endpoints: endpoints, client: client, breaker: breaker})
+	}
+
+	var replicas *endpointGroup
+	if endpoints := config.readEndpoints(); endpoints != nil {
+		client, breaker, err := newClient(name, config, endpoints)
+		if err != nil {
+			closeEndpointGroups(groups)
+			return nil, nil, err
+		}
+		replicas = &endpointGroup{endpoints: endpoints, client: client, breaker: breaker}
+	}
+
+	return groups, replicas, nil
+}
+
+// closeEndpointGroups closes the clients of endpoint groups no longer in use.
+func closeEndpointGroups(groups []*endpointGroup) {
+	for _, group := range groups {
+		if group.breaker != nil {
+			group.breaker.setListener(nil)
+		}
+		group.client.Close()
+	}
+}
+
+// withEndpoints returns the dial target of an endpoint group: a single endpoint is dialed as configured,
+// several endpoints are passed to the balancer as addresses of a static resolver.
+func withEndpoints(name string, endpoints []string, serverName string) (string, []grpc.DialOption) {
+	if len(endpoints) == 1 {
+		return endpoints[0], nil
+	}
+
+	addresses := make([]resolver.Address, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		host, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			host = endpoint
+		}
+		// the certificate of each endpoint is verified for its own host rather than the target,
+		// unless a server name is configured
+		if serverName != "" {
+			host = serverName
+		}
+		addresses = append(addresses, resolver.Address{Addr: endpoint, ServerName: host})
+	}
+
+	endpointResolver := manual.NewBuilderWithScheme("spicedb")
+	endpointResolver.InitialState(resolver.State{Addresses: addresses})
+	return "spicedb:///" + name, []grpc.DialOption{grpc.WithResolvers(endpointResolver)}
+}
+
+// withServiceConfig returns the gRPC service config of an endpoint group: the load balancing policy and the
+// retries of the idempotent methods. Nil if neither applies.
+func withServiceConfig(config ConnectionConfig, balanced bool) (grpc.DialOption, error) {
+	serviceConfig := map[string]any{}
+
+	if balanced && config.LoadBalancing == RoundRobin {
+		serviceConfig["loadBalancingConfig"] = []any{map[string]any{RoundRobin: map[string]any{}}}
+		serviceConfig["healthCheckConfig"] = map[string]any{"serviceName": healthCheckService}
+	}
+
+	if config.Retry != nil {
+		serviceConfig["methodConfig"] = []any{retryMethodConfig(*config.Retry)}
+	}
+
+	if len(serviceConfig) == 0 {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(serviceConfig)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithDefaultServiceConfig(string(encoded)), nil
+}
+
+// Client returns the client of the active endpoint group: the primary endpoints, unless failed over.
+// Writes are sent to it, reads use ReadClient.
+func (c *Connection) Client() *authzed.Client {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.groups[c.active].client
+}
+
+// clients returns the endpoint groups followed by the read replicas, if configured.
+func (c *Connection) clients() []*endpointGroup {
+	if c.replicas == nil {
+		return c.groups
+	}
+	return append(c.groups[:len(c.groups):len(c.groups)], c.replicas)
+}
+
+// ReadClient returns the client of the read replicas and true, or the client of the active endpoint group
+// and false if no replicas are configured or they are unavailable.
+func (c *Connection) ReadClient() (*authzed.Client, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.replicas == nil || c.replicasDown {
+		return c.groups[c.active].client, false
+	}
+	return c.replicas.client, true
+}
+
+// setReplicasDown sets whether reads are sent to the active endpoint group instead of the replicas,
+// and reports whether it changed.
+func (c *Connection) setReplicasDown(down bool) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	changed := c.replicasDown != down
+	c.replicasDown = down
+	return changed
+}
+
+// activeGroup returns the index of the active endpoint group.
+func (c *Connection) activeGroup() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.active
+}
+
+// setActive switches to the endpoint group and reports whether it changed.
+func (c *Connection) setActive(index int) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.active == index {
+		return false
+	}
+	c.active = index
+	close(c.activeChanged)
+	c.activeChanged = make(chan struct{})
+	return true
+}
+
+// activeContext derives a context canceled when the active endpoint group changes, so streams move to
+// the new group.
+func (c *Connection) activeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	c.mtx.Lock()
+	changed := c.activeChanged
+	c.mtx.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,175 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadyTimeout  = 10 * time.Second
+	defaultProbeInterval = 30 * time.Second
+)
+
+// HealthConfig configures how the connections to spicedb are probed.
+type HealthConfig struct {
+	ReadyTimeout  string `json:"ready_timeout"`  // time to wait for a connection to become ready, defaults to 10s
+	ProbeInterval string `json:"probe_interval"` // interval of the probes, defaults to 30s
+
+	readyTimeout  time.Duration
+	probeInterval time.Duration
+}
+
+// validate parses the configured durations.
+func (c *HealthConfig) validate() error {
+	c.readyTimeout = defaultReadyTimeout
+	if c.ReadyTimeout != "" {
+		timeout, err := time.ParseDuration(c.ReadyTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid health ready_timeout: '%s'", c.ReadyTimeout)
+		}
+		c.readyTimeout = timeout
+	}
+
+	c.probeInterval = defaultProbeInterval
+	if c.ProbeInterval != "" {
+		interval, err := time.ParseDuration(c.ProbeInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid health probe_interval: '%s'", c.ProbeInterval)
+		}
+		c.probeInterval = interval
+	}
+
+	return nil
+}
+
+// groupHealth is the outcome of the latest probe of an endpoint group.
+type groupHealth struct {
+	err         error
+	lastSuccess time.Time
+	peer        string // address of the endpoint that answered
+}
+
+// probe reports the health of a connection and fails over: requests are sent to the first endpoint group
+// whose probe succeeded, in order, so the primary endpoints are used again as soon as they recover.
+// The connection is not ready until the first probe succeeded, while all endpoint groups fail the plugin
+// is in error state. Reads are sent to the active endpoint group while the read replicas fail.
+func (p *SpicedbPlugin) probe(ctx context.Context, connection *Connection, config HealthConfig) {
+	component := componentName("health", connection)
+	probed := connection.clients()
+	health := make([]groupHealth, len(probed))
+
+	for {
+		var wg sync.WaitGroup
+		for i, group := range probed {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				peer, err := probeOnce(ctx, group, config.readyTimeout)
+				health[i].err = err
+				if err == nil {
+					health[i].lastSuccess = time.Now()
+					health[i].peer = peer
+				}
+			}()
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connection.replicas != nil {
+			err := health[len(probed)-1].err
+			if connection.setReplicasDown(err != nil) {
+				if err != nil {
+					p.manager.Logger().Warn("spicedb connection %s sends reads to the primary, replicas unavailable: %v", connection.Name, err)
+				} else {
+					p.manager.Logger().Warn("spicedb connection %s sends reads to the replicas again", connection.Name)
+				}
+			}
+		}
+
+		active := -1
+		for i := range connection.groups {
+			if health[i].err == nil {
+				active = i
+				break
+			}
+		}
+
+		if active < 0 {
+			p.reportStatus(component, "", errors.New(describeHealth(connection, health, connection.activeGroup())))
+			p.manager.Logger().Warn("spicedb connection %s unavailable: %v", connection.Name, health[connection.activeGroup()].err)
+		} else {
+			if connection.setActive(active) {
+				p.manager.Logger().Warn("spicedb connection %s switched to endpoints %s", connection.Name, connection.groups[active])
+			}
+			p.reportStatus(component, describeHealth(connection, health, active), nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.probeInterval):
+		}
+	}
+}
+
+// describeHealth renders the active endpoints and the probe results of the endpoint groups and the replicas.
+func describeHealth(connection *Connection, health []groupHealth, active int) string {
+	parts := make([]string, 0, len(health)+1)
+	probed := connection.clients()
+
+	if len(probed) > 1 || len(connection.groups[active].endpoints) > 1 {
+		description := "active " + connection.groups[active].String()
+		if peer := health[active].peer; peer != "" && len(connection.groups[active].endpoints) > 1 {
+			description += " via " + peer
+		}
+		parts = append(parts, description)
+	}
+
+	for i, result := range health {
+		name := probed[i].String()
+		if probed[i] == connection.replicas {
+			name = "replicas " + name
+		}
+
+		last := "never"
+		if !result.lastSuccess.IsZero() {
+			last = result.lastSuccess.Format(time.RFC3339)
+		}
+		if result.err == nil {
+			parts = append(parts, fmt.Sprintf("%s ready, last successful probe at %s", name, last))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s unavailable, last successful probe %s: %v", name, last, result.err))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// probeOnce waits for the endpoint group to become ready and reads the schema. It returns the address
+// of the endpoint that answered.
+func probeOnce(ctx context.Context, group *endpointGroup, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var answered peer.Peer
+	_, err := group.client.ReadSchema(ctx, &authzedpb.ReadSchemaRequest{}, grpc.WaitForReady(true), grpc.Peer(&answered), bypassBreaker{})
+	if err != nil && status.Code(err) != codes.NotFound {
+		// NotFound: no schema written yet, spicedb is reachable nevertheless
+		return "", err
+	}
+	if answered.Addr == nil {
+		return "", nil
+	}
+	return answered.Addr.String(), nil
+}
@@ -0,0 +1,262 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+	"io"
+	"sync"
+	"time"
+)
+
+// MirrorConfig selects the resource types whose relationships are mirrored into data.spicedb.relationships.
+type MirrorConfig struct {
+	ResourceTypes []string `json:"resource_types"`
+}
+
+var mirrorPath = storage.MustParsePath("/spicedb/relationships")
+
+// mirrorPruneInterval is how often relationships reaching their expiration are removed from the mirror,
+// spicedb sends no watch event when a relationship expires.
+const mirrorPruneInterval = 10 * time.Second
+
+// mirrorExpirations tracks the expiration of the mirrored relationships having one, by relationship key.
+// The lock is held while writing the mirror, so pruning doesn't interleave with watched changes.
+type mirrorExpirations struct {
+	mtx     sync.Mutex
+	expires map[string]time.Time
+}
+
+// track records the expiration of a mirrored relationship, or that it has none.
+func (e *mirrorExpirations) track(key string, relationship *authzedpb.Relationship) {
+	if expiresAt := relationship.GetOptionalExpiresAt(); expiresAt != nil {
+		e.expires[key] = expiresAt.AsTime()
+	} else {
+		delete(e.expires, key)
+	}
+}
+
+// mirror keeps data.spicedb.relationships in sync with spicedb: it writes a snapshot of the configured
+// resource types and applies the changes of the watch stream. After stream errors the snapshot is
+// taken again, as the stream position might have been garbage collected in the meantime.
+func (p *SpicedbPlugin) mirror(ctx context.Context, connection *Connection, resourceTypes []string) {
+	backoff := watchMinBackoff
+
+	objectTypes := make([]string, 0, len(resourceTypes))
+	for _, resourceType := range resourceTypes {
+		objectTypes = append(objectTypes, connection.Schemaprefix+resourceType)
+	}
+
+	for {
+		err := p.mirrorOnce(ctx, connection, objectTypes, func() {
+			backoff = watchMinBackoff
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.reportStatus("mirror", "", fmt.Errorf("relationships out of sync: %w", err))
+		p.manager.Logger().Warn("spicedb relationship mirror failed, resyncing in %v: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// mirrorOnce writes a snapshot and applies watched changes until the stream fails.
+func (p *SpicedbPlugin) mirrorOnce(ctx context.Context, connection *Connection, objectTypes []string, synced func()) error {
+	// after a failover the snapshot is taken from the new endpoints
+	ctx, cancel := connection.activeContext(ctx)
+	defer cancel()
+
+	client := connection.Client()
+
+	// the schema revision is used as snapshot revision for all resource types
+	schema, err := client.ReadSchema(ctx, &authzedpb.ReadSchemaRequest{})
+	if err != nil {
+		return err
+	}
+	revision := schema.ReadAt
+
+	relationships := make(map[string]any)
+	expirations := &mirrorExpirations{expires: make(map[string]time.Time)}
+	for _, objectType := range objectTypes {
+		stream, err := client.ReadRelationships(ctx, &authzedpb.ReadRelationshipsRequest{
+			Consistency: &authzedpb.Consistency{
+				Requirement: &authzedpb.Consistency_AtExactSnapshot{AtExactSnapshot: revision},
+			},
+			RelationshipFilter: &authzedpb.RelationshipFilter{ResourceType: objectType},
+		})
+		if err != nil {
+			return err
+		}
+
+		for {
+			result, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if !InSchemaprefix(result.Relationship, connection.Schemaprefix) {
+				continue
+			}
+			relationship := NewRelationship(result.Relationship, connection.Schemaprefix)
+			relationships[relationship.Key()] = relationship
+			expirations.track(relationship.Key(), result.Relationship)
+		}
+	}
+
+	if err := p.writeMirror(ctx, storage.AddOp, mirrorPath, relationships); err != nil {
+		return err
+	}
+
+	synced()
+	p.reportStatus("mirror", "relationships in sync", nil)
+
+	go p.pruneMirror(ctx, expirations)
+
+	watch, err := client.Watch(ctx, &authzedpb.WatchRequest{
+		OptionalObjectTypes: objectTypes,
+		OptionalStartCursor: revision,
+		OptionalUpdateKinds: []authzedpb.WatchKind{
+			authzedpb.WatchKind_WATCH_KIND_INCLUDE_RELATIONSHIP_UPDATES,
+			authzedpb.WatchKind_WATCH_KIND_INCLUDE_CHECKPOINTS,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := watch.Recv()
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Updates) > 0 {
+			if err := p.applyMirrorUpdates(ctx, connection, resp.Updates, expirations); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// applyMirrorUpdates applies the relationship updates of a watch response within a single transaction.
+func (p *SpicedbPlugin) applyMirrorUpdates(ctx context.Context, connection *Connection, updates []*authzedpb.RelationshipUpdate, expirations *mirrorExpirations) error {
+	store := p.manager.Store
+
+	expirations.mtx.Lock()
+	defer expirations.mtx.Unlock()
+
+	return storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		for _, update := range updates {
+			if !InSchemaprefix(update.Relationship, connection.Schemaprefix) {
+				continue
+			}
+			relationship := NewRelationship(update.Relationship, connection.Schemaprefix)
+			path := append(mirrorPath[:len(mirrorPath):len(mirrorPath)], relationship.Key())
+
+			if update.Operation == authzedpb.RelationshipUpdate_OPERATION_DELETE {
+				if err := store.Write(ctx, txn, storage.RemoveOp, path, nil); err != nil && !storage.IsNotFound(err) {
+					return err
+				}
+				delete(expirations.expires, relationship.Key())
+				continue
+			}
+			expirations.track(relationship.Key(), update.Relationship)
+
+			var value any = relationship
+			if err := util.RoundTrip(&value); err != nil {
+				return err
+			}
+			if err := store.Write(ctx, txn, storage.AddOp, path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneMirror removes the mirrored relationships reaching their expiration until the context is done.
+func (p *SpicedbPlugin) pruneMirror(ctx context.Context, expirations *mirrorExpirations) {
+	ticker := time.NewTicker(mirrorPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := p.pruneExpired(ctx, expirations, now); err != nil && ctx.Err() == nil {
+				p.manager.Logger().Warn("spicedb relationship mirror failed to remove expired relationships: %v", err)
+			}
+		}
+	}
+}
+
+// pruneExpired removes the mirrored relationships expired at the given time within a single transaction.
+func (p *SpicedbPlugin) pruneExpired(ctx context.Context, expirations *mirrorExpirations, now time.Time) error {
+	store := p.manager.Store
+
+	expirations.mtx.Lock()
+	defer expirations.mtx.Unlock()
+
+	var expired []string
+	for key, expires := range expirations.expires {
+		if !expires.After(now) {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	err := storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		for _, key := range expired {
+			path := append(mirrorPath[:len(mirrorPath):len(mirrorPath)], key)
+			if err := store.Write(ctx, txn, storage.RemoveOp, path, nil); err != nil && !storage.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		delete(expirations.expires, key)
+	}
+	return nil
+}
+
+// writeMirror writes a document below data.spicedb within a single transaction, creating the parents if necessary.
+func (p *SpicedbPlugin) writeMirror(ctx context.Context, op storage.PatchOp, path storage.Path, value any) error {
+	store := p.manager.Store
+
+	if err := util.RoundTrip(&value); err != nil {
+		return err
+	}
+
+	return storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		if err := storage.MakeDir(ctx, store, txn, path[:len(path)-1]); err != nil {
+			return err
+		}
+		return store.Write(ctx, txn, op, path, value)
+	})
+}
@@ -0,0 +1,86 @@
+package spicedb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMirrorPrunesExpiredRelationships(t *testing.T) {
+	ctx := context.Background()
+	manager, err := plugins.New([]byte(`{}`), "test", inmem.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &SpicedbPlugin{manager: manager}
+
+	now := time.Now()
+	relationship := func(subject string, expiresAt time.Time) *authzedpb.Relationship {
+		rel := &authzedpb.Relationship{
+			Resource: &authzedpb.ObjectReference{ObjectType: "document", ObjectId: "doc1"},
+			Relation: "viewer",
+			Subject:  &authzedpb.SubjectReference{Object: &authzedpb.ObjectReference{ObjectType: "user", ObjectId: subject}},
+		}
+		if !expiresAt.IsZero() {
+			rel.OptionalExpiresAt = timestamppb.New(expiresAt)
+		}
+		return rel
+	}
+	touch := func(rel *authzedpb.Relationship) *authzedpb.RelationshipUpdate {
+		return &authzedpb.RelationshipUpdate{Operation: authzedpb.RelationshipUpdate_OPERATION_TOUCH, Relationship: rel}
+	}
+
+	if err := plugin.writeMirror(ctx, storage.AddOp, mirrorPath, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	expirations := &mirrorExpirations{expires: make(map[string]time.Time)}
+	updates := []*authzedpb.RelationshipUpdate{
+		touch(relationship("alice", time.Time{})),
+		touch(relationship("bob", now.Add(time.Minute))),
+		touch(relationship("carol", now.Add(time.Hour))),
+		// the expiration of carol is removed again
+		touch(relationship("carol", time.Time{})),
+	}
+	if err := plugin.applyMirrorUpdates(ctx, &Connection{}, updates, expirations); err != nil {
+		t.Fatal(err)
+	}
+
+	mirrored := func() map[string]any {
+		t.Helper()
+		value, err := storage.ReadOne(ctx, manager.Store, mirrorPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value.(map[string]any)
+	}
+
+	tests := []struct {
+		at       time.Time
+		expected []string
+	}{
+		{now, []string{"alice", "bob", "carol"}},
+		{now.Add(2 * time.Minute), []string{"alice", "carol"}},
+		{now.Add(2 * time.Hour), []string{"alice", "carol"}},
+	}
+
+	for _, test := range tests {
+		if err := plugin.pruneExpired(ctx, expirations, test.at); err != nil {
+			t.Fatal(err)
+		}
+		relationships := mirrored()
+		if len(relationships) != len(test.expected) {
+			t.Fatalf("at %v: expected %v, got %v", test.at, test.expected, relationships)
+		}
+		for _, subject := range test.expected {
+			if _, found := relationships["document:doc1#viewer@user:"+subject]; !found {
+				t.Fatalf("at %v: expected %v, got %v", test.at, test.expected, relationships)
+			}
+		}
+	}
+}
@@ -1,92 +1,297 @@
 package spicedb
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/authzed/authzed-go/v1"
-	"github.com/authzed/grpcutil"
 	"github.com/open-policy-agent/opa/plugins"
 	"github.com/open-policy-agent/opa/util"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"sync"
+	"time"
 )
 
 const PluginName = "spicedb"
 
+// connectionDrainTimeout is the time requests in flight have to complete before a replaced client is closed.
+const connectionDrainTimeout = 30 * time.Second
+
 type Config struct {
-	Endpoint string `json:"endpoint"`
-	Insecure bool   `json:"insecure"`
-	Token    string `json:"token"`
-	Schemaprefix    string `json:"schemaprefix"`
+	ConnectionConfig                             // the default connection, unless configured in connections
+	Connections      map[string]ConnectionConfig `json:"connections"`    // named connections, selectable per builtin call
+	Watch            bool                        `json:"watch"`          // cache results across queries, evicted by the watch stream
+	Mirror           *MirrorConfig               `json:"mirror"`         // mirror relationships into data.spicedb.relationships
+	Cache            *CacheConfig                `json:"cache"`          // bound the results cached across queries
+	Health           *HealthConfig               `json:"health"`         // readiness timeout and probe interval
+	OnUnavailable    map[string]string           `json:"on_unavailable"` // per builtin: error, deny or stale
+	StaleCache       *StaleCacheConfig           `json:"stale_cache"`    // bound the results served while unavailable
 }
 
 type SpicedbPlugin struct {
-	manager *plugins.Manager
-	mtx     sync.Mutex
-	config  Config
-	client  *authzed.Client
+	manager     *plugins.Manager
+	mtx         sync.Mutex
+	config      Config
+	connections map[string]*Connection
+
+	cancel context.CancelFunc // stops the watch streams and the mirror
+
+	statusMtx  sync.Mutex
+	components map[string]componentStatus
 }
 
 var instance *SpicedbPlugin = nil
-var Schemaprefix string = ""
 
+// GetAuthzedClient returns the client of the default connection.
 func GetAuthzedClient() *authzed.Client {
-
-	if instance == nil {
+	connection, err := GetConnection(DefaultConnection)
+	if err != nil {
 		return nil
 	}
-
-	instance.mtx.Lock()
-	defer instance.mtx.Unlock()
-
-	return instance.client
+	return connection.Client()
 }
 
 func (p *SpicedbPlugin) Start(ctx context.Context) error {
 
-	grpcSecurity, err := grpcutil.WithSystemCerts(grpcutil.VerifyCA)
-	if p.config.Insecure {
-		grpcSecurity = grpc.WithTransportCredentials(insecure.NewCredentials())
+	connections, err := buildConnections(p.config, Config{}, nil)
+	if err != nil {
+		p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateErr, Message: err.Error()})
+		return err
 	}
-	
-	if p.config.Schemaprefix != "" {
-		Schemaprefix = p.config.Schemaprefix
-	}
-
-	client, err := authzed.NewClient(
-		p.config.Endpoint,
-		// grpcutil.WithSystemCerts(grpcutil.VerifyCA),
-		grpcSecurity,
-		grpcutil.WithInsecureBearerToken(p.config.Token),
-	)
 
-	p.client = client
+	p.mtx.Lock()
+	p.connections = connections
+	p.mtx.Unlock()
 
-	// Expose plugin instance in global to be able to access the authzed client from the custom builtins
+	// Expose plugin instance in global to be able to access the authzed clients from the custom builtins
 	instance = p
 
-	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateOK})
+	p.resetStatus()
+	p.startBackground(p.config, connections, nil)
 
-	return err
+	return nil
 
 }
 
 func (p *SpicedbPlugin) Stop(ctx context.Context) {
+	p.stopBackground()
+
+	p.mtx.Lock()
+	connections := p.connections
+	p.connections = nil
+	p.mtx.Unlock()
+
+	for _, connection := range connections {
+		closeEndpointGroups(connection.clients())
+	}
+
+	p.resetStatus()
 	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
 }
 
+// Reconfigure applies a changed configuration: the clients of the new configuration are created before
+// they are swapped in, clients of unchanged connections are kept. If the new configuration can't be
+// applied, the previous one stays in use.
 func (p *SpicedbPlugin) Reconfigure(ctx context.Context, config any) {
-	// Todo: Lock schemaprefix
+	newConfig := config.(Config)
+
+	p.mtx.Lock()
+	previousConfig, previous := p.config, p.connections
+	p.mtx.Unlock()
+
+	if sameConfig(previousConfig, newConfig) {
+		return
+	}
+
+	connections, err := buildConnections(newConfig, previousConfig, previous)
+	if err != nil {
+		// reported as component, so the status of the running connections doesn't hide it; cleared by the
+		// next successful reconfiguration
+		p.manager.Logger().Error("spicedb reconfiguration failed, keeping the previous configuration: %v", err)
+		p.reportStatus("reconfiguration", "", fmt.Errorf("failed, keeping the previous configuration: %w", err))
+		return
+	}
+
+	p.stopBackground()
+
+	p.mtx.Lock()
+	p.config = newConfig
+	p.connections = connections
+	p.mtx.Unlock()
+
+	kept := make(map[string]bool)
+	for name := range connections {
+		kept[name] = reusable(name, newConfig, previousConfig, previous)
+	}
+
+	p.resetStatusExcept(kept)
+	p.startBackground(newConfig, connections, kept)
+
+	closeReplacedClients(previous, connections)
+}
+
+// buildConnections creates the connections of a configuration. The endpoint groups of connections configured
+// as in the previous configuration are reused.
+func buildConnections(config Config, previousConfig Config, previous map[string]*Connection) (map[string]*Connection, error) {
+	var cacheConfig *CacheConfig
+	if config.Cache != nil {
+		cacheConfig = config.Cache
+	} else if config.Watch {
+		cacheConfig = &CacheConfig{}
+	}
+
+	connections := make(map[string]*Connection, len(config.Connections))
+	var created []*Connection
+
+	for name, connectionConfig := range config.Connections {
+		old := previous[name]
+		reused := reusable(name, config, previousConfig, previous)
+
+		var groups []*endpointGroup
+		var replicas *endpointGroup
+		if reused {
+			groups, replicas = old.groups, old.replicas
+		} else {
+			var err error
+			if groups, replicas, err = newEndpointGroups(name, connectionConfig); err != nil {
+				for _, connection := range created {
+					closeEndpointGroups(connection.clients())
+				}
+				return nil, err
+			}
+		}
+
+		connection := newConnection(name, connectionConfig, groups, replicas)
+		if reused {
+			connection.active = old.activeGroup()
+		} else {
+			created = append(created, connection)
+		}
+		connection.onUnavailable = config.OnUnavailable
+		if usesStale(config.OnUnavailable) {
+			if reused && old.stale != nil {
+				// the last known results of an unchanged connection remain valid
+				connection.stale = old.stale
+			} else {
+				staleConfig := StaleCacheConfig{}
+				if config.StaleCache != nil {
+					staleConfig = *config.StaleCache
+				}
+				connection.stale = newStaleCache(staleConfig)
+			}
+		}
+		if cacheConfig != nil {
+			// entries without TTL are accepted once the watch stream is connected
+			connection.cache = newResultCache(*cacheConfig)
+		}
+		connections[name] = connection
+	}
+
+	return connections, nil
+}
+
+// closeReplacedClients closes the clients no longer in use, after the requests in flight had time to complete.
+func closeReplacedClients(previous, connections map[string]*Connection) {
+	inUse := make(map[*endpointGroup]bool)
+	for _, connection := range connections {
+		for _, group := range connection.clients() {
+			inUse[group] = true
+		}
+	}
+
+	for _, connection := range previous {
+		replaced := []*endpointGroup{}
+		for _, group := range connection.clients() {
+			if !inUse[group] {
+				replaced = append(replaced, group)
+			}
+		}
+		if len(replaced) == 0 {
+			continue
+		}
+		for _, group := range replaced {
+			if group.breaker != nil {
+				group.breaker.setListener(nil)
+			}
+		}
+		time.AfterFunc(connectionDrainTimeout, func() {
+			closeEndpointGroups(replaced)
+		})
+	}
+}
+
+// reusable reports whether the clients of a connection can be reused, as it is configured as before.
+func reusable(name string, config Config, previousConfig Config, previous map[string]*Connection) bool {
+	_, found := previous[name]
+	return found && sameConfig(previousConfig.Connections[name], config.Connections[name])
+}
+
+// startBackground starts the health probes, the watch streams and the relationship mirror of a configuration.
+// The plugin is not ready until the first probe of every connection succeeded, connections kept by a
+// reconfiguration stay ready.
+func (p *SpicedbPlugin) startBackground(config Config, connections map[string]*Connection, kept map[string]bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	p.mtx.Lock()
-	defer p.mtx.Unlock()
+	p.cancel = cancel
+	p.mtx.Unlock()
 
-	if p.config.Endpoint != config.(Config).Endpoint {
-		p.Stop(ctx)
-		if err := p.Start(ctx); err != nil {
-			p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateErr})
+	health := HealthConfig{}
+	if config.Health != nil {
+		health = *config.Health
+	}
+	if err := health.validate(); err != nil {
+		// validated with the plugin configuration already
+		p.manager.Logger().Error("spicedb health configuration: %v", err)
+	}
+	for _, connection := range connections {
+		if !kept[connection.Name] {
+			p.reportNotReady(componentName("health", connection), fmt.Sprintf("waiting for %s", connection.groups[0]))
 		}
+		go p.probe(ctx, connection, health)
+
+		for _, group := range connection.clients() {
+			if group.breaker == nil {
+				continue
+			}
+			component := componentName("breaker", connection)
+			if len(connection.clients()) > 1 {
+				component = fmt.Sprintf("%s(%s)", component, group)
+			}
+			group.breaker.setListener(func(message string, err error) {
+				p.reportStatus(component, message, err)
+			})
+		}
+	}
+
+	if config.Watch {
+		for _, connection := range connections {
+			go p.watch(ctx, connection, connection.cache)
+		}
+	}
+
+	if config.Mirror != nil && len(config.Mirror.ResourceTypes) > 0 {
+		go p.mirror(ctx, connections[DefaultConnection], config.Mirror.ResourceTypes)
+	}
+}
+
+// stopBackground stops the health probes, the watch streams and the relationship mirror.
+func (p *SpicedbPlugin) stopBackground() {
+	p.mtx.Lock()
+	cancel := p.cancel
+	p.cancel = nil
+	p.mtx.Unlock()
+
+	if cancel != nil {
+		cancel()
 	}
-	p.config = config.(Config)
+}
+
+// sameConfig compares configurations by their JSON representation.
+func sameConfig(a, b any) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
 }
 
 type Factory struct{}
@@ -103,6 +308,52 @@ func (Factory) New(m *plugins.Manager, config any) plugins.Plugin {
 
 func (Factory) Validate(_ *plugins.Manager, config []byte) (any, error) {
 	parsedConfig := Config{}
-	err := util.Unmarshal(config, &parsedConfig)
-	return parsedConfig, err
+	if err := util.Unmarshal(config, &parsedConfig); err != nil {
+		return parsedConfig, err
+	}
+
+	// the top level endpoint is the default connection, without it only the named connections exist
+	if _, found := parsedConfig.Connections[DefaultConnection]; found {
+		if parsedConfig.hasEndpoint() {
+			return parsedConfig, fmt.Errorf("the default connection is configured twice, in endpoint and connections.%s", DefaultConnection)
+		}
+	} else if parsedConfig.hasEndpoint() || len(parsedConfig.Connections) == 0 {
+		if parsedConfig.Connections == nil {
+			parsedConfig.Connections = make(map[string]ConnectionConfig)
+		}
+		parsedConfig.Connections[DefaultConnection] = parsedConfig.ConnectionConfig
+	}
+
+	for name, connection := range parsedConfig.Connections {
+		if err := connection.validate(); err != nil {
+			return parsedConfig, fmt.Errorf("connection %s: %w", name, err)
+		}
+		parsedConfig.Connections[name] = connection
+	}
+
+	if _, found := parsedConfig.Connections[DefaultConnection]; !found && parsedConfig.Mirror != nil && len(parsedConfig.Mirror.ResourceTypes) > 0 {
+		return parsedConfig, fmt.Errorf("mirror reads from the default connection, configure endpoint or connections.%s", DefaultConnection)
+	}
+
+	if parsedConfig.Cache != nil {
+		if err := parsedConfig.Cache.validate(); err != nil {
+			return parsedConfig, err
+		}
+	}
+
+	if parsedConfig.Health != nil {
+		if err := parsedConfig.Health.validate(); err != nil {
+			return parsedConfig, err
+		}
+	}
+
+	if err := validateOnUnavailable(parsedConfig.OnUnavailable); err != nil {
+		return parsedConfig, err
+	}
+	if parsedConfig.StaleCache != nil {
+		if err := parsedConfig.StaleCache.validate(); err != nil {
+			return parsedConfig, err
+		}
+	}
+	return parsedConfig, nil
 }
@@ -0,0 +1,161 @@
+package spicedb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+func TestValidateDefaultConnection(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		connections []string
+		valid       bool
+	}{
+		{"top level endpoint", `{"endpoint": "spicedb:50051"}`, []string{"default"}, true},
+		{"named connections only", `{"connections": {"eu": {"endpoint": "spicedb-eu:50051"}}}`, []string{"eu"}, true},
+		{"top level and named connections", `{"endpoint": "spicedb:50051", "connections": {"eu": {"endpoint": "spicedb-eu:50051"}}}`, []string{"default", "eu"}, true},
+		{"no endpoint", `{}`, nil, false},
+		{"named connection without endpoint", `{"connections": {"eu": {"token": "secret"}}}`, nil, false},
+		{"default configured twice", `{"endpoint": "spicedb:50051", "connections": {"default": {"endpoint": "spicedb-eu:50051"}}}`, nil, false},
+		{"mirror without default connection", `{"connections": {"eu": {"endpoint": "spicedb-eu:50051"}}, "mirror": {"resource_types": ["document"]}}`, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := Factory{}.Validate(nil, []byte(test.config))
+			if !test.valid {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			connections := parsed.(Config).Connections
+			if len(connections) != len(test.connections) {
+				t.Fatalf("expected connections %v, got %v", test.connections, connections)
+			}
+			for _, name := range test.connections {
+				if _, found := connections[name]; !found {
+					t.Fatalf("expected connections %v, got %v", test.connections, connections)
+				}
+			}
+		})
+	}
+}
+
+func TestReconfigureFailureReported(t *testing.T) {
+	manager, err := plugins.New([]byte(`{}`), "test", inmem.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(config string) Config {
+		t.Helper()
+		parsed, err := Factory{}.Validate(manager, []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.(Config)
+	}
+
+	plugin := Factory{}.New(manager, validate(`{"endpoint": "127.0.0.1:1", "insecure": true}`)).(*SpicedbPlugin)
+	if err := plugin.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Stop(context.Background())
+
+	// the CA file is read when the connection is created, after validation
+	plugin.Reconfigure(context.Background(), validate(`{"endpoint": "127.0.0.1:1", "ca_cert": "/nonexistent/ca.crt"}`))
+
+	// a later probe result must not hide the failed reconfiguration
+	plugin.reportStatus("health", "127.0.0.1:1 ready", nil)
+	status := manager.PluginStatus()[PluginName]
+	if status.State != plugins.StateErr || !strings.Contains(status.Message, "reconfiguration") {
+		t.Fatalf("expected the failed reconfiguration in the status, got %v: %s", status.State, status.Message)
+	}
+
+	plugin.Reconfigure(context.Background(), validate(`{"endpoint": "127.0.0.1:2", "insecure": true}`))
+	plugin.reportStatus("health", "127.0.0.1:2 ready", nil)
+	status = manager.PluginStatus()[PluginName]
+	if strings.Contains(status.Message, "reconfiguration") {
+		t.Fatalf("expected the failure to be cleared by a successful reconfiguration, got %s", status.Message)
+	}
+}
+
+func TestReconfigureKeepsStatusOfReusedConnections(t *testing.T) {
+	manager, err := plugins.New([]byte(`{}`), "test", inmem.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(config string) Config {
+		t.Helper()
+		parsed, err := Factory{}.Validate(manager, []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.(Config)
+	}
+
+	// the probes of the unreachable endpoints don't report within the test
+	plugin := Factory{}.New(manager, validate(`{"endpoint": "127.0.0.1:1", "insecure": true, "health": {"ready_timeout": "1h"},
+		"connections": {"eu": {"endpoint": "127.0.0.1:2", "insecure": true}}}`)).(*SpicedbPlugin)
+	if err := plugin.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Stop(context.Background())
+
+	plugin.reportStatus("health", "127.0.0.1:1 ready", nil)
+	plugin.reportStatus("health[eu]", "127.0.0.1:2 ready", nil)
+	if state := manager.PluginStatus()[PluginName].State; state != plugins.StateOK {
+		t.Fatalf("expected the plugin to be ready, got %v", state)
+	}
+
+	// only the eu connection is rebuilt
+	plugin.Reconfigure(context.Background(), validate(`{"endpoint": "127.0.0.1:1", "insecure": true, "health": {"ready_timeout": "1h"},
+		"connections": {"eu": {"endpoint": "127.0.0.1:3", "insecure": true}}}`))
+
+	plugin.statusMtx.Lock()
+	defaultHealth, euHealth := plugin.components["health"], plugin.components["health[eu]"]
+	plugin.statusMtx.Unlock()
+
+	if defaultHealth.notReady || defaultHealth.message != "127.0.0.1:1 ready" {
+		t.Fatalf("expected the reused connection to stay ready, got %+v", defaultHealth)
+	}
+	if !euHealth.notReady {
+		t.Fatalf("expected the rebuilt connection to wait for its probe, got %+v", euHealth)
+	}
+
+	plugin.reportStatus("health[eu]", "127.0.0.1:3 ready", nil)
+	if state := manager.PluginStatus()[PluginName].State; state != plugins.StateOK {
+		t.Fatalf("expected the plugin to be ready, got %v", state)
+	}
+}
+
+func TestParseComponentName(t *testing.T) {
+	tests := []struct {
+		name       string
+		component  string
+		connection string
+	}{
+		{"health", "health", DefaultConnection},
+		{"health[eu]", "health", "eu"},
+		{"breaker(spicedb-0:50051)", "breaker", DefaultConnection},
+		{"breaker[eu](spicedb-eu:50051)", "breaker", "eu"},
+		{"reconfiguration", "reconfiguration", DefaultConnection},
+	}
+
+	for _, test := range tests {
+		if component, connection := parseComponentName(test.name); component != test.component || connection != test.connection {
+			t.Errorf("%s: expected %s %s, got %s %s", test.name, test.component, test.connection, component, connection)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package spicedb
+
+import (
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"strings"
+	"time"
+)
+
+// Relationship is the rego representation of a spicedb relationship, without the schema prefix.
+// It is returned by spicedb.read_relationships and mirrored into data.spicedb.relationships.
+type Relationship struct {
+	ResourceType    string         `json:"resourceType"`
+	ResourceId      string         `json:"resourceId"`
+	Relationship    string         `json:"relationship"`
+	SubjectType     string         `json:"subjectType"`
+	SubjectId       string         `json:"subjectId"`
+	SubjectRelation string         `json:"subjectRelation,omitempty"`
+	CaveatName      string         `json:"caveatName,omitempty"`
+	CaveatContext   map[string]any `json:"caveatContext,omitempty"`
+	ExpiresAt       string         `json:"expiresAt,omitempty"`
+}
+
+// NewRelationship converts a spicedb relationship, removing the schema prefix.
+func NewRelationship(relationship *authzedpb.Relationship, schemaprefix string) Relationship {
+	relation := Relationship{
+		ResourceType:    strings.TrimPrefix(relationship.Resource.GetObjectType(), schemaprefix),
+		ResourceId:      relationship.Resource.GetObjectId(),
+		Relationship:    relationship.Relation,
+		SubjectType:     strings.TrimPrefix(relationship.Subject.GetObject().GetObjectType(), schemaprefix),
+		SubjectId:       relationship.Subject.GetObject().GetObjectId(),
+		SubjectRelation: relationship.Subject.GetOptionalRelation(),
+	}
+	if caveat := relationship.OptionalCaveat; caveat != nil {
+		relation.CaveatName = strings.TrimPrefix(caveat.CaveatName, schemaprefix)
+		relation.CaveatContext = caveat.Context.AsMap()
+	}
+	if expiresAt := relationship.OptionalExpiresAt; expiresAt != nil {
+		relation.ExpiresAt = expiresAt.AsTime().Format(time.RFC3339)
+	}
+	return relation
+}
+
+// InSchemaprefix reports whether the resource and the subject of a relationship are defined within the schema prefix,
+// relationships referencing types of other prefixes must not be returned.
+func InSchemaprefix(relationship *authzedpb.Relationship, schemaprefix string) bool {
+	return strings.HasPrefix(relationship.Resource.GetObjectType(), schemaprefix) &&
+		strings.HasPrefix(relationship.Subject.GetObject().GetObjectType(), schemaprefix)
+}
+
+// Key renders the relationship as "resourceType:resourceId#relationship@subjectType:subjectId[#subjectRelation]".
+func (r Relationship) Key() string {
+	key := fmt.Sprintf("%s:%s#%s@%s:%s", r.ResourceType, r.ResourceId, r.Relationship, r.SubjectType, r.SubjectId)
+	if r.SubjectRelation != "" {
+		key += "#" + r.SubjectRelation
+	}
+	return key
+}
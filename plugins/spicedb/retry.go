@@ -0,0 +1,91 @@
+package spicedb
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+
+	// grpc caps the attempts of a retry policy
+	maxRetryAttempts = 5
+)
+
+// idempotentMethods are retried on UNAVAILABLE, writes and deletes are never retried.
+var idempotentMethods = map[string][]string{
+	"authzed.api.v1.PermissionsService": {
+		"CheckPermission", "CheckBulkPermissions", "LookupResources", "LookupSubjects", "ReadRelationships", "ExpandPermissionTree",
+	},
+	"authzed.api.v1.SchemaService": {
+		"ReadSchema", "ReflectSchema",
+	},
+}
+
+// RetryConfig configures retries of idempotent requests failing with UNAVAILABLE. The backoff grows
+// exponentially with random jitter, retries end when the deadline of the evaluation is exceeded.
+type RetryConfig struct {
+	MaxAttempts    int    `json:"max_attempts"`    // including the first attempt, at most 5
+	InitialBackoff string `json:"initial_backoff"` // defaults to 100ms
+	MaxBackoff     string `json:"max_backoff"`     // defaults to 1s
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// validate checks the attempts and parses the backoff durations.
+func (c *RetryConfig) validate() error {
+	if c.MaxAttempts < 2 || c.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("invalid retry max_attempts: %d, must be between 2 and %d", c.MaxAttempts, maxRetryAttempts)
+	}
+
+	c.initialBackoff = defaultInitialBackoff
+	if c.InitialBackoff != "" {
+		backoff, err := time.ParseDuration(c.InitialBackoff)
+		if err != nil || backoff <= 0 {
+			return fmt.Errorf("invalid retry initial_backoff: '%s'", c.InitialBackoff)
+		}
+		c.initialBackoff = backoff
+	}
+
+	c.maxBackoff = defaultMaxBackoff
+	if c.MaxBackoff != "" {
+		backoff, err := time.ParseDuration(c.MaxBackoff)
+		if err != nil || backoff <= 0 {
+			return fmt.Errorf("invalid retry max_backoff: '%s'", c.MaxBackoff)
+		}
+		c.maxBackoff = backoff
+	}
+	if c.maxBackoff < c.initialBackoff {
+		return fmt.Errorf("retry max_backoff %v is shorter than initial_backoff %v", c.maxBackoff, c.initialBackoff)
+	}
+
+	return nil
+}
+
+// retryMethodConfig returns the gRPC method config retrying the idempotent methods.
+func retryMethodConfig(config RetryConfig) map[string]any {
+	type methodName struct {
+		Service string `json:"service"`
+		Method  string `json:"method"`
+	}
+
+	names := []methodName{}
+	for service, methods := range idempotentMethods {
+		for _, method := range methods {
+			names = append(names, methodName{Service: service, Method: method})
+		}
+	}
+
+	return map[string]any{
+		"name": names,
+		"retryPolicy": map[string]any{
+			"maxAttempts":          config.MaxAttempts,
+			"initialBackoff":       fmt.Sprintf("%gs", config.initialBackoff.Seconds()),
+			"maxBackoff":           fmt.Sprintf("%gs", config.maxBackoff.Seconds()),
+			"backoffMultiplier":    2,
+			"retryableStatusCodes": []string{"UNAVAILABLE"},
+		},
+	}
+}
@@ -0,0 +1,175 @@
+package spicedb
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// on_unavailable policies of the builtins
+const (
+	UnavailableError = "error" // return the error object
+	UnavailableDeny  = "deny"  // return {"result": false}
+	UnavailableStale = "stale" // return the last known result, marked as stale
+)
+
+const defaultStaleMaxEntries = 10000
+
+// unavailableBuiltins lists the builtins an on_unavailable policy can be configured for, "default" applies
+// to all builtins without own policy. Writes and deletes always return the error.
+var unavailableBuiltins = map[string]bool{
+	"default":                true,
+	"check_permission":       true,
+	"check_bulk_permissions": true,
+	"lookup_resources":       true,
+	"lookup_subjects":        true,
+	"read_relationships":     true,
+	"expand_permission_tree": true,
+	"read_schema":            true,
+	"reflect_schema":         true,
+}
+
+// StaleCacheConfig bounds the last known results served while spicedb is unavailable.
+type StaleCacheConfig struct {
+	MaxEntries int    `json:"max_entries"` // defaults to 10000
+	MaxAge     string `json:"max_age"`     // older results are not served, unlimited by default
+
+	maxAge time.Duration
+}
+
+// validate checks the bounds and parses the maximum age.
+func (c *StaleCacheConfig) validate() error {
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("invalid stale_cache max_entries: %d", c.MaxEntries)
+	}
+
+	if c.MaxAge != "" {
+		maxAge, err := time.ParseDuration(c.MaxAge)
+		if err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid stale_cache max_age: '%s'", c.MaxAge)
+		}
+		c.maxAge = maxAge
+	}
+
+	return nil
+}
+
+// validateOnUnavailable checks the builtins and policies of an on_unavailable configuration.
+func validateOnUnavailable(policies map[string]string) error {
+	for builtin, policy := range policies {
+		if !unavailableBuiltins[builtin] {
+			return fmt.Errorf("unknown builtin in on_unavailable: '%s'", builtin)
+		}
+		switch policy {
+		case UnavailableError, UnavailableDeny, UnavailableStale:
+		default:
+			return fmt.Errorf("invalid on_unavailable policy for %s: '%s', must be error, deny or stale", builtin, policy)
+		}
+	}
+	return nil
+}
+
+// usesStale reports whether any builtin serves stale results.
+func usesStale(policies map[string]string) bool {
+	for _, policy := range policies {
+		if policy == UnavailableStale {
+			return true
+		}
+	}
+	return false
+}
+
+// staleCache keeps the last known results of a connection, least recently used results are dropped
+// first when exceeding the maximum number of entries.
+type staleCache struct {
+	mtx        sync.Mutex
+	maxEntries int
+	maxAge     time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type staleEntry struct {
+	key     string
+	value   any
+	fetched time.Time
+}
+
+func newStaleCache(config StaleCacheConfig) *staleCache {
+	maxEntries := config.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = defaultStaleMaxEntries
+	}
+	return &staleCache{
+		maxEntries: maxEntries,
+		maxAge:     config.maxAge,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *staleCache) get(key string) (any, time.Duration, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, 0, false
+	}
+
+	entry := element.Value.(*staleEntry)
+	age := time.Since(entry.fetched)
+	if c.maxAge > 0 && age > c.maxAge {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+
+	c.lru.MoveToFront(element)
+	return entry.value, age, true
+}
+
+func (c *staleCache) put(key string, value any) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if element, found := c.entries[key]; found {
+		element.Value = &staleEntry{key: key, value: value, fetched: time.Now()}
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&staleEntry{key: key, value: value, fetched: time.Now()})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Remove(c.lru.Back()).(*staleEntry)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// OnUnavailable returns the policy of the builtin applied when spicedb is unavailable.
+func (c *Connection) OnUnavailable(builtin string) string {
+	if policy, found := c.onUnavailable[builtin]; found {
+		return policy
+	}
+	if policy, found := c.onUnavailable["default"]; found {
+		return policy
+	}
+	return UnavailableError
+}
+
+// StaleGet returns the last known result stored under the key together with its age.
+func (c *Connection) StaleGet(key string) (any, time.Duration, bool) {
+	if c.stale == nil {
+		return nil, 0, false
+	}
+	return c.stale.get(key)
+}
+
+// StalePut stores the latest result under the key, to be served while spicedb is unavailable.
+func (c *Connection) StalePut(key string, value any) {
+	if c.stale == nil {
+		return
+	}
+	c.stale.put(key, value)
+}
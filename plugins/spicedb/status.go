@@ -0,0 +1,121 @@
+package spicedb
+
+import (
+	"fmt"
+	"github.com/open-policy-agent/opa/plugins"
+	"sort"
+	"strings"
+)
+
+type componentStatus struct {
+	message  string
+	err      error
+	notReady bool
+}
+
+// parseComponentName returns the component and the connection of a name built by componentName.
+func parseComponentName(name string) (string, string) {
+	component, connection := name, DefaultConnection
+	if end := strings.IndexAny(name, "[("); end >= 0 {
+		component = name[:end]
+	}
+	if start := strings.IndexByte(name, '['); start >= 0 {
+		if end := strings.IndexByte(name[start:], ']'); end >= 0 {
+			connection = name[start+1 : start+end]
+		}
+	}
+	return component, connection
+}
+
+// componentName names the component of a connection in the status message, the name of the default
+// connection is omitted.
+func componentName(component string, connection *Connection) string {
+	if connection.Name == DefaultConnection {
+		return component
+	}
+	return fmt.Sprintf("%s[%s]", component, connection.Name)
+}
+
+// reportStatus updates the status of a background component (e.g. the watch stream) and reports the
+// combined plugin status: the plugin is in error state while any component is failing.
+func (p *SpicedbPlugin) reportStatus(component string, message string, err error) {
+	p.updateStatus(component, componentStatus{message: message, err: err})
+}
+
+// reportNotReady marks a component as not ready yet, e.g. before the first health probe: the plugin
+// is not ready until all components are.
+func (p *SpicedbPlugin) reportNotReady(component string, message string) {
+	p.updateStatus(component, componentStatus{message: message, notReady: true})
+}
+
+func (p *SpicedbPlugin) updateStatus(component string, current componentStatus) {
+	p.statusMtx.Lock()
+	defer p.statusMtx.Unlock()
+
+	if p.components == nil {
+		p.components = make(map[string]componentStatus)
+	}
+
+	if previous, found := p.components[component]; found && previous.message == current.message &&
+		previous.notReady == current.notReady && fmt.Sprint(previous.err) == fmt.Sprint(current.err) {
+		return
+	}
+	p.components[component] = current
+	p.publishStatus()
+}
+
+// publishStatus reports the combined status of the components to the plugin manager, the lock must be held.
+func (p *SpicedbPlugin) publishStatus() {
+	names := make([]string, 0, len(p.components))
+	for name := range p.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	state := plugins.StateOK
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		status := p.components[name]
+		if status.err != nil {
+			state = plugins.StateErr
+			messages = append(messages, fmt.Sprintf("%s: %v", name, status.err))
+		} else {
+			if status.notReady && state == plugins.StateOK {
+				state = plugins.StateNotReady
+			}
+			messages = append(messages, fmt.Sprintf("%s: %s", name, status.message))
+		}
+	}
+
+	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{
+		State:   state,
+		Message: strings.Join(messages, "; "),
+	})
+}
+
+// resetStatus forgets the component states, e.g. when the plugin is stopped.
+func (p *SpicedbPlugin) resetStatus() {
+	p.statusMtx.Lock()
+	defer p.statusMtx.Unlock()
+
+	p.components = nil
+}
+
+// resetStatusExcept forgets the component states, except the health and circuit breaker states of the
+// connections kept by a reconfiguration: their clients are reused and stay ready.
+func (p *SpicedbPlugin) resetStatusExcept(kept map[string]bool) {
+	p.statusMtx.Lock()
+	defer p.statusMtx.Unlock()
+
+	for name := range p.components {
+		component, connection := parseComponentName(name)
+		if (component != "health" && component != "breaker") || !kept[connection] {
+			delete(p.components, name)
+		}
+	}
+
+	// without components the status is reported as the background components start
+	if len(p.components) > 0 {
+		p.publishStatus()
+	}
+}
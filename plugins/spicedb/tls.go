@@ -0,0 +1,207 @@
+package spicedb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pemSource is a PEM value configured inline or as file path. Files are read again when they change on disk.
+type pemSource struct {
+	value string
+
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func newPEMSource(value string) *pemSource {
+	if value == "" {
+		return nil
+	}
+	return &pemSource{value: value}
+}
+
+// inline reports whether the value is the PEM data itself rather than a file path.
+func (s *pemSource) inline() bool {
+	return strings.Contains(s.value, "-----BEGIN")
+}
+
+// load returns the PEM data and whether it changed since the last call.
+func (s *pemSource) load() ([]byte, bool, error) {
+	if s.inline() {
+		changed := s.data == nil
+		s.data = []byte(s.value)
+		return s.data, changed, nil
+	}
+
+	info, err := os.Stat(s.value)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.data != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.data, false, nil
+	}
+
+	data, err := os.ReadFile(s.value)
+	if err != nil {
+		return nil, false, err
+	}
+	s.data, s.modTime, s.size = data, info.ModTime(), info.Size()
+	return data, true, nil
+}
+
+// tlsFiles holds the CA and client certificate of a connection, reloaded on TLS handshakes when the
+// files changed, so rotated certificates are used without restarting OPA.
+type tlsFiles struct {
+	mtx           sync.Mutex
+	ca, cert, key *pemSource
+	roots         *x509.CertPool
+	clientCert    *tls.Certificate
+}
+
+// reload reads changed files and rebuilds the CA pool and the client certificate.
+func (t *tlsFiles) reload() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.ca != nil {
+		data, changed, err := t.ca.load()
+		if err != nil {
+			return fmt.Errorf("ca_cert: %w", err)
+		}
+		if changed || t.roots == nil {
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(data) {
+				return errors.New("ca_cert: no certificates found")
+			}
+			t.roots = roots
+		}
+	}
+
+	if t.cert != nil {
+		certData, certChanged, err := t.cert.load()
+		if err != nil {
+			return fmt.Errorf("client_cert: %w", err)
+		}
+		keyData, keyChanged, err := t.key.load()
+		if err != nil {
+			return fmt.Errorf("client_key: %w", err)
+		}
+		if certChanged || keyChanged || t.clientCert == nil {
+			certificate, err := tls.X509KeyPair(certData, keyData)
+			if err != nil {
+				// cert and key files might be replaced one after the other, keep the previous pair until both match
+				if t.clientCert != nil {
+					return nil
+				}
+				return fmt.Errorf("client certificate: %w", err)
+			}
+			t.clientCert = &certificate
+		}
+	}
+
+	return nil
+}
+
+func (t *tlsFiles) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.clientCert, nil
+}
+
+// rootCAs returns the current CA pool, nil if no CA is configured.
+func (t *tlsFiles) rootCAs() (*x509.CertPool, error) {
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.roots, nil
+}
+
+// reloadingCredentials are TLS transport credentials verifying the server against the current CA pool:
+// every handshake uses a copy of the TLS config with the reloaded CA, keeping the default verification of
+// the certificate chain and of the dialed host name or IP address, or the configured server_name.
+type reloadingCredentials struct {
+	credentials.TransportCredentials
+	config *tls.Config
+	files  *tlsFiles
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	roots, err := c.files.rootCAs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := c.config.Clone()
+	config.RootCAs = roots
+	return credentials.NewTLS(config).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	return &reloadingCredentials{TransportCredentials: c.TransportCredentials.Clone(), config: c.config.Clone(), files: c.files}
+}
+
+// tlsConfigured reports whether a custom CA, client certificate or server name is configured.
+func (c *ConnectionConfig) tlsConfigured() bool {
+	return c.CACert != "" || c.ClientCert != "" || c.ClientKey != "" || c.ServerName != ""
+}
+
+// withTLS returns the transport credentials of a custom CA and client certificate.
+func withTLS(config ConnectionConfig) (grpc.DialOption, error) {
+	creds, err := newTLSCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(creds), nil
+}
+
+// newTLSCredentials loads the CA and client certificate and creates the TLS credentials reloading them.
+func newTLSCredentials(config ConnectionConfig) (credentials.TransportCredentials, error) {
+	files := &tlsFiles{
+		ca:   newPEMSource(config.CACert),
+		cert: newPEMSource(config.ClientCert),
+		key:  newPEMSource(config.ClientKey),
+	}
+	if err := files.reload(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+
+	if files.cert != nil {
+		tlsConfig.GetClientCertificate = files.getClientCertificate
+	}
+
+	if files.ca == nil {
+		return credentials.NewTLS(tlsConfig), nil
+	}
+
+	// the CA pool of the config can't be replaced once in use, each handshake gets a copy with the current CA
+	return &reloadingCredentials{
+		TransportCredentials: credentials.NewTLS(tlsConfig),
+		config:               tlsConfig,
+		files:                files,
+	}, nil
+}
@@ -0,0 +1,138 @@
+package spicedb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// newTestCA returns the PEM of a CA and a server certificate signed by it for the DNS names.
+func newTestCA(t *testing.T, dnsNames ...string) (string, tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, ca, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return string(caPEM), tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+}
+
+// handshake dials a TLS server presenting the certificate and runs the client handshake of the credentials.
+// Like gRPC, the authority is the configured server name or else the dialed address.
+func handshake(t *testing.T, creds credentials.TransportCredentials, certificate tls.Certificate) error {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authority := listener.Addr().String()
+	if serverName := creds.Info().ServerName; serverName != "" {
+		authority = serverName
+	}
+
+	secured, _, err := creds.ClientHandshake(ctx, authority, conn)
+	if err == nil {
+		secured.Close()
+	}
+	return err
+}
+
+func TestCACertVerifiesHost(t *testing.T) {
+	caPEM, certificate := newTestCA(t, "spicedb.internal")
+
+	tests := []struct {
+		name       string
+		serverName string
+		valid      bool
+	}{
+		{"ip endpoint, certificate of another host", "", false},
+		{"server_name matching the certificate", "spicedb.internal", true},
+		{"server_name of another host", "other.internal", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			creds, err := newTLSCredentials(ConnectionConfig{CACert: caPEM, ServerName: test.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = handshake(t, creds, certificate)
+			if test.valid && err != nil {
+				t.Fatalf("expected a valid handshake, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the certificate to be rejected")
+			}
+		})
+	}
+}
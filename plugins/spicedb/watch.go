@@ -0,0 +1,113 @@
+package spicedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	authzedpb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"time"
+)
+
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = 30 * time.Second
+)
+
+// watch subscribes to the spicedb watch stream and evicts the cached results affected by changed
+// relationships. After stream errors it reconnects with the last seen revision; entries cached while
+// disconnected could miss changes, so the cache is cleared and only accepts entries with a TTL until
+// the stream is back. When the connection fails over, the stream is moved to the new endpoints and starts
+// at their current revision, as revisions of another cluster are not valid there.
+// Results are read at least as fresh as the last revision seen on the stream, see ReadConsistency. Relationships
+// reaching their expiration don't produce watch events, entries are kept for watchedTTL at most.
+func (p *SpicedbPlugin) watch(ctx context.Context, connection *Connection, cache *resultCache) {
+	var cursor *authzedpb.ZedToken
+	cursorGroup := connection.activeGroup()
+	backoff := watchMinBackoff
+
+	for {
+		if active := connection.activeGroup(); active != cursorGroup {
+			cursor, cursorGroup = nil, active
+			connection.setRevision("")
+		}
+
+		streamCtx, cancelStream := connection.activeContext(ctx)
+		stream, err := connection.Client().Watch(streamCtx, &authzedpb.WatchRequest{
+			OptionalStartCursor: cursor,
+			OptionalUpdateKinds: []authzedpb.WatchKind{
+				authzedpb.WatchKind_WATCH_KIND_INCLUDE_RELATIONSHIP_UPDATES,
+				authzedpb.WatchKind_WATCH_KIND_INCLUDE_SCHEMA_UPDATES,
+				authzedpb.WatchKind_WATCH_KIND_INCLUDE_CHECKPOINTS,
+			},
+		})
+
+		connected := false
+		for err == nil {
+			var resp *authzedpb.WatchResponse
+			resp, err = stream.Recv()
+			if err != nil {
+				break
+			}
+
+			if !connected {
+				// the stream is established once the first response (at least a checkpoint) arrives
+				connected = true
+				backoff = watchMinBackoff
+				cache.reset(true)
+				p.setWatchStatus(connection, nil)
+			}
+
+			// the revision is updated before evicting: reads started after the eviction are at least as fresh
+			if resp.ChangesThrough != nil {
+				cursor = resp.ChangesThrough
+				connection.setRevision(cursor.Token)
+			}
+
+			if resp.SchemaUpdated {
+				cache.reset(true)
+			} else if len(resp.Updates) > 0 {
+				changed := make(map[string]bool)
+				for _, update := range resp.Updates {
+					changed[update.Relationship.GetResource().GetObjectType()] = true
+				}
+				cache.evict(changed)
+			}
+		}
+
+		failedOver := streamCtx.Err() != nil
+		cancelStream()
+		if ctx.Err() != nil {
+			return
+		}
+
+		cache.reset(false)
+		if failedOver {
+			backoff = watchMinBackoff
+			p.setWatchStatus(connection, errors.New("endpoints changed, reconnecting"))
+			continue
+		}
+		p.setWatchStatus(connection, err)
+		p.manager.Logger().Warn("spicedb watch stream of connection %s failed, reconnecting in %v: %v", connection.Name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// setWatchStatus reports the watch stream health in the plugin status.
+func (p *SpicedbPlugin) setWatchStatus(connection *Connection, err error) {
+	component := componentName("watch", connection)
+	if err != nil {
+		p.reportStatus(component, "", fmt.Errorf("stream disconnected: %w", err))
+		return
+	}
+	p.reportStatus(component, "stream connected", nil)
+}